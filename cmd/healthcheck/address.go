@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+// Values of -address.
+const (
+	interfaceAddress = "interface"
+	instanceAddress  = "instance"
+)
+
+// instanceIP is the address of the instance on the host, set by
+// validateAddress when -address is instance.
+var instanceIP string
+
+// validateAddress checks the value of -address and, when it is instance, that
+// the address of the instance is known and the ports are mapped to the ports
+// of the host.
+func validateAddress() []error {
+	switch *addressFlag {
+	case interfaceAddress:
+		return nil
+	case instanceAddress:
+	default:
+		return []error{fmt.Errorf("invalid value %q for -address: must be interface or instance", *addressFlag)}
+	}
+
+	problems := []error{}
+	if *portMappingFlag != externalPortMapping && *portMappingFlag != externalTLSProxyPortMapping {
+		problems = append(problems, fmt.Errorf("-address=instance requires -port-mapping to be external or external-tls-proxy, the internal ports are not reachable on the address of the instance"))
+	}
+
+	ip, err := lookupInstanceIP()
+	if err != nil {
+		return append(problems, err)
+	}
+	instanceIP = ip
+	return problems
+}
+
+// lookupInstanceIP returns CF_INSTANCE_IP, or the host of CF_INSTANCE_ADDR
+// when it is not set.
+func lookupInstanceIP() (string, error) {
+	if ip := os.Getenv("CF_INSTANCE_IP"); ip != "" {
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid CF_INSTANCE_IP %q: not an IP address", ip)
+		}
+		return ip, nil
+	}
+
+	addr := os.Getenv("CF_INSTANCE_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("neither CF_INSTANCE_IP nor CF_INSTANCE_ADDR is set")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid CF_INSTANCE_ADDR %q: must be IP:PORT", addr)
+	}
+	return host, nil
+}
+
+// withAddress returns a checker running h against the address selected by
+// -address.
+func withAddress(h healthcheck.HealthCheck) healthcheck.Checker {
+	if *addressFlag != instanceAddress {
+		return &h
+	}
+	debugf("checking address %s of the instance", instanceIP)
+	return &hostChecker{h: h, host: instanceIP}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes the delay between checks. Every call to next grows the
+// interval by multiplier, up to max, and randomly spreads the returned delay
+// by up to jitter of the interval in either direction so that many instances
+// restarting at once do not check in lockstep.
+type backoff struct {
+	interval   time.Duration
+	multiplier float64
+	max        time.Duration
+	jitter     float64
+}
+
+func newBackoff(initial time.Duration, multiplier float64, max time.Duration, jitter float64) *backoff {
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	return &backoff{interval: initial, multiplier: multiplier, max: max, jitter: jitter}
+}
+
+func (b *backoff) next() time.Duration {
+	delay := b.interval
+	if b.max > 0 && delay > b.max {
+		delay = b.max
+	}
+
+	b.interval = time.Duration(float64(b.interval) * b.multiplier)
+	if b.max > 0 && b.interval > b.max {
+		b.interval = b.max
+	}
+
+	if b.jitter == 0 {
+		return delay
+	}
+	// #nosec G404 - jitter does not need a cryptographically secure random number
+	spread := b.jitter * (2*rand.Float64() - 1)
+	return time.Duration(float64(delay) * (1 + spread))
+}
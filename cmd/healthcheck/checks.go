@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+type checkSpecs []string
+
+// listFlags are the repeatable flags, which take comma separated lists in
+// environment variables and lists in the config file.
+var listFlags = map[string]*checkSpecs{
+	"check":               &checks,
+	"dependency":          &dependencies,
+	"optional-dependency": &optionalDependencies,
+}
+
+func (c *checkSpecs) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *checkSpecs) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// parseQuorum converts the value of the -require flag into a quorum for
+// healthcheck.NewCompositeHealthCheck.
+func parseQuorum(require string) (int, error) {
+	switch require {
+	case "all":
+		return healthcheck.QuorumAll, nil
+	case "any":
+		return healthcheck.QuorumAny, nil
+	}
+
+	quorum, err := strconv.Atoi(require)
+	if err != nil || quorum < 1 {
+		return 0, fmt.Errorf("invalid value %q for -require: must be all, any or a positive number", require)
+	}
+	return quorum, nil
+}
+
+// checkSpec is a parsed -check value.
+type checkSpec struct {
+	kind string
+	port string
+	uri  string
+}
+
+// parseCheckSpec parses a -check value of the form tcp:PORT, tls:PORT or
+// http:PORT/URI.
+func parseCheckSpec(spec string) (checkSpec, error) {
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return checkSpec{}, fmt.Errorf("invalid value %q for -check: must be tcp:PORT, tls:PORT or http:PORT/URI", spec)
+	}
+
+	switch kind {
+	case "tcp", "tls":
+		return checkSpec{kind: kind, port: target}, nil
+	case "http":
+		checkPort, checkURI, found := strings.Cut(target, "/")
+		if !found || checkPort == "" {
+			return checkSpec{}, fmt.Errorf("invalid value %q for -check: http checks must be http:PORT/URI", spec)
+		}
+		return checkSpec{kind: kind, port: checkPort, uri: "/" + checkURI}, nil
+	}
+
+	return checkSpec{}, fmt.Errorf("invalid value %q for -check: unknown check type %q", spec, kind)
+}
+
+func (s checkSpec) healthCheck() healthcheck.HealthCheck {
+	if s.kind == "tls" {
+		return newTLSHealthCheck(*network, s.port, *timeout, *tlsCertExpiryWindow)
+	}
+	return newHealthCheck(*network, s.uri, s.port, *timeout)
+}
+
+// portURIs returns the URI to check on each port in the comma separated -port
+// flag. When -port is a list, -uri may either hold a single URI used for every
+// port, or one URI per port. -uri is only split when -port is a list, so that
+// a single port may be checked on a URI containing commas.
+func portURIs(ports []string) ([]string, error) {
+	if len(ports) == 1 {
+		return []string{*uri}, nil
+	}
+
+	uris := strings.Split(*uri, ",")
+	switch len(uris) {
+	case 1:
+		checkURIs := []string{}
+		for range ports {
+			checkURIs = append(checkURIs, *uri)
+		}
+		return checkURIs, nil
+	case len(ports):
+		return uris, nil
+	}
+	return nil, fmt.Errorf("invalid value %q for -uri: expected 1 or %d URIs for ports %s", *uri, len(ports), *port)
+}
+
+// portChecks builds one healthcheck per port in the comma separated -port
+// flag.
+func portChecks() ([]healthcheck.Component, error) {
+	ports := strings.Split(*port, ",")
+	uris, err := portURIs(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	components := []healthcheck.Component{}
+	for i, p := range ports {
+		var h healthcheck.HealthCheck
+		if *tlsCert {
+			h = newTLSHealthCheck(*network, p, *timeout, *tlsCertExpiryWindow)
+		} else {
+			h = newHealthCheck(*network, uris[i], p, *timeout)
+		}
+		h.SetLogger(debugf)
+		h.SetTracer(probeTracer)
+		components = append(components, healthcheck.Component{Name: "port " + p, Checker: withAddress(h)})
+	}
+	return components, nil
+}
+
+func newChecker() (healthcheck.Checker, error) {
+	if probe != nil {
+		return probeChecker(probe), nil
+	}
+
+	var components []healthcheck.Component
+	if len(checks) == 0 {
+		var err error
+		components, err = portChecks()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(components) == 1 {
+			return components[0].Checker, nil
+		}
+	}
+
+	quorum, err := parseQuorum(*require)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, spec := range checks {
+		parsed, err := parseCheckSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		h := parsed.healthCheck()
+		h.SetLogger(debugf)
+		h.SetTracer(probeTracer)
+		components = append(components, healthcheck.Component{Name: spec, Checker: withAddress(h)})
+	}
+
+	composite := healthcheck.NewCompositeHealthCheck(quorum, components...)
+	return &composite, nil
+}
+
+// describeTarget describes what the healthcheck checks in the form of -check
+// values, e.g. http:8080/health,tcp:9090.
+func describeTarget() string {
+	if probe != nil {
+		return describeProbe(probe)
+	}
+	if len(checks) > 0 {
+		return strings.Join(checks, ",")
+	}
+
+	ports := strings.Split(*port, ",")
+	uris, err := portURIs(ports)
+	if err != nil {
+		return *port
+	}
+	targets := []string{}
+	for i, p := range ports {
+		checkURI := uris[i]
+		switch {
+		case *tlsCert:
+			targets = append(targets, "tls:"+p)
+		case checkURI != "":
+			targets = append(targets, "http:"+p+checkURI)
+		default:
+			targets = append(targets, "tcp:"+p)
+		}
+	}
+	return strings.Join(targets, ",")
+}
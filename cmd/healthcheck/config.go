@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile sets every flag that was not given on the command line to
+// its value in the YAML or JSON config file at path. The keys of the file are
+// the flag names. It returns every problem found in the file.
+func applyConfigFile(path string) []error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read config file: %s", err)}
+	}
+
+	config := map[string]interface{}{}
+	err = yaml.Unmarshal(contents, &config)
+	if err != nil {
+		return []error{fmt.Errorf("failed to parse config file %s: %s", path, err)}
+	}
+
+	explicit := explicitFlags()
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := []error{}
+	for _, key := range keys {
+		if key == "config" || flag.Lookup(key) == nil {
+			problems = append(problems, fmt.Errorf("invalid key %q in config file %s", key, path))
+			continue
+		}
+		if explicit[key] {
+			continue
+		}
+
+		values, err := configValues(key, config[key])
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		for _, value := range values {
+			err := flag.Set(key, value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("invalid value %q for key %q in config file %s: %s", value, key, path, err))
+			}
+		}
+	}
+
+	return problems
+}
+
+// configValues converts a value of the config file into the values to set the
+// flag to. Lists are set one by one for the repeatable flags and are joined
+// with commas for the port and uri flags. Checks may also be given as
+// maps with type, port and uri keys.
+func configValues(key string, value interface{}) ([]string, error) {
+	list, isList := value.([]interface{})
+	if !isList {
+		s, err := configScalar(key, value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+
+	values := []string{}
+	for _, item := range list {
+		s, err := configScalar(key, item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+
+	if _, ok := listFlags[key]; ok {
+		return values, nil
+	}
+	switch key {
+	case "port", "uri":
+		return []string{strings.Join(values, ",")}, nil
+	}
+	return nil, fmt.Errorf("invalid value for key %q in config file: lists are only supported for check, dependency, optional-dependency, port and uri", key)
+}
+
+func configScalar(key string, value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", fmt.Errorf("invalid value for key %q in config file: missing value", key)
+	case map[string]interface{}:
+		if key != "check" {
+			return "", fmt.Errorf("invalid value for key %q in config file: maps are only supported for check", key)
+		}
+
+		kind, _ := value["type"].(string)
+		checkPort := fmt.Sprint(value["port"])
+		checkURI, _ := value["uri"].(string)
+		if kind == "" || value["port"] == nil {
+			return "", fmt.Errorf("invalid value for key %q in config file: checks need a type and a port", key)
+		}
+		if checkURI != "" && !strings.HasPrefix(checkURI, "/") {
+			checkURI = "/" + checkURI
+		}
+		return kind + ":" + checkPort + checkURI, nil
+	case []interface{}:
+		return "", fmt.Errorf("invalid value for key %q in config file: nested lists are not supported", key)
+	}
+
+	return fmt.Sprint(value), nil
+}
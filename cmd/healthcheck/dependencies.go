@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+var dependencies, optionalDependencies checkSpecs
+
+var dependencyTimeout = flag.Duration(
+	"dependency-timeout",
+	1*time.Second,
+	"Only relevant if dependency or optional-dependency is set. Timeout of every dependency check, including resolving the host",
+)
+
+func init() {
+	flag.Var(
+		&dependencies,
+		"dependency",
+		"Only relevant in readiness, until-ready and lifecycle modes. Critical dependency of the app, of the form tcp:HOST:PORT, http:HOST:PORT/URI or https:HOST:PORT/URI, checked along with the app. The app is not ready while it is down. May be repeated",
+	)
+	flag.Var(
+		&optionalDependencies,
+		"optional-dependency",
+		"Only relevant in readiness, until-ready and lifecycle modes. Like dependency, but the app stays ready while it is down and the healthcheck only logs that it is degraded. May be repeated",
+	)
+}
+
+// dependencySpec is a parsed -dependency or -optional-dependency value.
+type dependencySpec struct {
+	name string
+	kind string
+	host string
+	port string
+	uri  string
+}
+
+// parseDependencySpec parses a dependency of the form tcp:HOST:PORT,
+// http:HOST:PORT/URI or https:HOST:PORT/URI. IPv6 hosts are enclosed in
+// brackets, e.g. tcp:[::1]:5432.
+func parseDependencySpec(flagName, spec string) (dependencySpec, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid value %q for -%s: %s", spec, flagName, reason)
+	}
+
+	kind, target, ok := strings.Cut(spec, ":")
+	if !ok || target == "" {
+		return dependencySpec{}, invalid("must be tcp:HOST:PORT, http:HOST:PORT/URI or https:HOST:PORT/URI")
+	}
+
+	address, path, hasPath := strings.Cut(target, "/")
+	switch kind {
+	case "tcp":
+		if hasPath {
+			return dependencySpec{}, invalid("tcp dependencies must be tcp:HOST:PORT")
+		}
+	case "http", "https":
+		if !hasPath {
+			return dependencySpec{}, invalid(kind + " dependencies must be " + kind + ":HOST:PORT/URI")
+		}
+	default:
+		return dependencySpec{}, invalid(fmt.Sprintf("unknown dependency type %q", kind))
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || port == "" {
+		return dependencySpec{}, invalid("must name a host and a port")
+	}
+
+	d := dependencySpec{name: spec, kind: kind, host: host, port: port}
+	if hasPath {
+		d.uri = "/" + path
+	}
+	return d, nil
+}
+
+// validateDependencies returns every invalid dependency.
+func validateDependencies() []error {
+	problems := []error{}
+	for _, f := range []struct {
+		name  string
+		specs checkSpecs
+	}{
+		{"dependency", dependencies},
+		{"optional-dependency", optionalDependencies},
+	} {
+		for _, spec := range f.specs {
+			if _, err := parseDependencySpec(f.name, spec); err != nil {
+				problems = append(problems, err)
+			}
+		}
+	}
+	if *dependencyTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("invalid value %s for -dependency-timeout: must be positive", *dependencyTimeout))
+	}
+	return problems
+}
+
+func (d dependencySpec) checker() healthcheck.Checker {
+	var h healthcheck.HealthCheck
+	if d.kind == "https" {
+		h = healthcheck.NewHTTPSHealthCheck("tcp", d.uri, d.port, *dependencyTimeout)
+	} else {
+		h = healthcheck.NewHealthCheck("tcp", d.uri, d.port, *dependencyTimeout)
+	}
+	h.SetLogger(debugf)
+	h.SetTracer(probeTracer)
+	return &hostChecker{h: h, host: d.host}
+}
+
+type dependency struct {
+	name     string
+	critical bool
+	checker  healthcheck.Checker
+}
+
+// dependencyChecker runs the check of the app along with the checks of its
+// dependencies, in parallel. It fails when the app or a critical dependency
+// is down, and logs when an optional dependency goes down or recovers.
+type dependencyChecker struct {
+	app          healthcheck.Checker
+	dependencies []dependency
+
+	// mu guards degraded, which holds the optional dependencies that were
+	// down at their last check.
+	mu       sync.Mutex
+	degraded map[string]bool
+}
+
+// withDependencies returns a checker of the app and its dependencies, or app
+// when none is set. The dependencies have been validated by
+// validateDependencies.
+func withDependencies(app healthcheck.Checker) healthcheck.Checker {
+	if len(dependencies) == 0 && len(optionalDependencies) == 0 {
+		return app
+	}
+
+	c := &dependencyChecker{app: app, degraded: map[string]bool{}}
+	for _, f := range []struct {
+		name     string
+		specs    checkSpecs
+		critical bool
+	}{
+		{"dependency", dependencies, true},
+		{"optional-dependency", optionalDependencies, false},
+	} {
+		for _, spec := range f.specs {
+			// #nosec G104 - dependencies are validated before the checks run
+			d, _ := parseDependencySpec(f.name, spec)
+			c.dependencies = append(c.dependencies, dependency{name: d.name, critical: f.critical, checker: d.checker()})
+		}
+	}
+	return c
+}
+
+func (c *dependencyChecker) CheckInterfaces(interfaces []net.Interface) error {
+	return c.CheckInterfacesContext(context.Background(), interfaces)
+}
+
+func (c *dependencyChecker) CheckInterfacesContext(ctx context.Context, interfaces []net.Interface) error {
+	// The timings of an attempt are those of the app, not of its dependencies.
+	dependencyCtx := healthcheck.WithHTTPTimingsHandler(ctx, nil)
+
+	errs := make([]error, len(c.dependencies))
+	wg := sync.WaitGroup{}
+	for i, d := range c.dependencies {
+		wg.Add(1)
+		go func(i int, checker healthcheck.Checker) {
+			defer wg.Done()
+			errs[i] = checker.CheckInterfacesContext(dependencyCtx, nil)
+		}(i, d.checker)
+	}
+	appErr := c.app.CheckInterfacesContext(ctx, interfaces)
+	wg.Wait()
+
+	var criticalErr error
+	for i, d := range c.dependencies {
+		if d.critical {
+			if errs[i] != nil && criticalErr == nil {
+				criticalErr = dependencyError(d.name, errs[i])
+			}
+			continue
+		}
+		c.recordOptional(d.name, errs[i])
+	}
+
+	if appErr != nil {
+		return appErr
+	}
+	return criticalErr
+}
+
+// recordOptional logs when an optional dependency goes down or recovers.
+func (c *dependencyChecker) recordOptional(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case err != nil && !c.degraded[name]:
+		c.degraded[name] = true
+		message, _ := describeFailure(err)
+		logf(warnLevel, "Warning: degraded, optional dependency %s is down: %s", name, message)
+	case err == nil && c.degraded[name]:
+		delete(c.degraded, name)
+		logf(warnLevel, "optional dependency %s recovered", name)
+	}
+}
+
+// dependencyError prefixes the error of a critical dependency with its name,
+// keeping the code of the error. Its timings are dropped, the timings of an
+// attempt are those of the app.
+func dependencyError(name string, err error) error {
+	hcErr, ok := err.(healthcheck.HealthCheckError)
+	if !ok {
+		message, code := describeFailure(err)
+		hcErr = healthcheck.HealthCheckError{Code: code, Message: message}
+	}
+	hcErr.Message = fmt.Sprintf("dependency %s is down: %s", name, hcErr.Message)
+	hcErr.Timings = nil
+	return hcErr
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const envPrefix = "HEALTHCHECK_"
+
+// envName returns the environment variable setting the flag, e.g.
+// HEALTHCHECK_LIVENESS_INTERVAL for -liveness-interval.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets every flag that was not given on the command line to
+// the value of its HEALTHCHECK_* environment variable, if set. The repeatable
+// flags take comma separated lists. It returns every invalid value.
+func applyEnvironment() []error {
+	explicit := explicitFlags()
+
+	problems := []error{}
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] {
+			return
+		}
+
+		values := []string{value}
+		if _, ok := listFlags[f.Name]; ok {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			err := flag.Set(f.Name, v)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("invalid value %q for %s: %s", v, envName(f.Name), err))
+			}
+		}
+	})
+
+	return problems
+}
+
+// printConfig prints the value of every flag in the config file format.
+func printConfig() error {
+	config := map[string]interface{}{}
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config", "print-config":
+			return
+		}
+		if list, ok := listFlags[f.Name]; ok {
+			config[f.Name] = []string(*list)
+			return
+		}
+		config[f.Name] = f.Value.String()
+	})
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+// observer is notified of every check, of the transitions between the stages
+// of the lifecycle mode and of the final result of the healthcheck.
+type observer interface {
+	attempted(a attemptEvent)
+	transitioned(from string, to []string)
+	finished(code int, message string)
+}
+
+type attemptEvent struct {
+	mode     string
+	attempt  int
+	duration time.Duration
+	err      error
+	// timings is the breakdown of the duration of the HTTP check of the
+	// attempt, if any.
+	timings *healthcheck.HTTPTimings
+}
+
+// attemptTimings records the timings of the HTTP checks run by an attempt.
+type attemptTimings struct {
+	mu      sync.Mutex
+	slowest *healthcheck.HTTPTimings
+}
+
+// withAttemptTimings returns a context recording the timings of the HTTP
+// checks run with it.
+func withAttemptTimings(ctx context.Context) (context.Context, *attemptTimings) {
+	t := &attemptTimings{}
+	return healthcheck.WithHTTPTimingsHandler(ctx, t.record), t
+}
+
+func (t *attemptTimings) record(timings healthcheck.HTTPTimings) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.slowest == nil || timings.Total() > t.slowest.Total() {
+		t.slowest = &timings
+	}
+}
+
+// of returns the timings to report for an attempt that returned err, i.e. the
+// timings of the failed HTTP check, or else of the slowest HTTP check.
+func (t *attemptTimings) of(err error) *healthcheck.HTTPTimings {
+	if hErr, ok := err.(healthcheck.HealthCheckError); ok && hErr.Timings != nil {
+		return hErr.Timings
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.slowest
+}
+
+var observers []observer
+
+func notifyAttempt(a attemptEvent) {
+	for _, o := range observers {
+		o.attempted(a)
+	}
+}
+
+func notifyTransition(from string, to []string) {
+	for _, o := range observers {
+		o.transitioned(from, to)
+	}
+}
+
+// finish prints the message, notifies the observers and exits with code.
+func finish(code int, message string) {
+	if message != "" {
+		fmt.Fprintf(os.Stderr, "%s\n", message)
+	}
+	for _, o := range observers {
+		o.finished(code, message)
+	}
+	exit(code)
+}
+
+// exit exits with the process exit code of code.
+func exit(code int) {
+	os.Exit(processExitCode(code))
+}
+
+// processExitCode returns the code to exit with for the detailed exit code,
+// i.e. 1 for every failure when -exit-codes is docker.
+func processExitCode(code int) int {
+	if code != 0 && *exitCodes == "docker" {
+		return 1
+	}
+	return code
+}
+
+// errorCategory names the kind of failure an exit code stands for.
+func errorCategory(code int) string {
+	switch code {
+	case 0:
+		return ""
+	case 3:
+		return "interface"
+	case 4:
+		return "tcp_connection"
+	case 5:
+		return "http_request"
+	case 6:
+		return "http_status"
+	case 7:
+		return "tls_handshake"
+	case 8:
+		return "tls_certificate"
+	case 9:
+		return "exec"
+	case 10:
+		return "grpc_request"
+	case 11:
+		return "grpc_status"
+	case 64, 65, 66, 67, 68:
+		return "timeout"
+	case startupStageFailed:
+		return "startup_stage"
+	case livenessStageFailed:
+		return "liveness_stage"
+	case readinessStageFailed:
+		return "readiness_stage"
+	case stoppedCode:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// textObserver writes human readable lines for the events that are not
+// failures, which are written to stderr by finish.
+type textObserver struct {
+	w io.Writer
+}
+
+func (o *textObserver) attempted(attemptEvent) {}
+
+func (o *textObserver) transitioned(from string, to []string) {
+	fmt.Fprintf(o.w, "%s check passed, starting %s checks\n", capitalize(from), strings.Join(to, " and "))
+}
+
+func (o *textObserver) finished(int, string) {}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+type jsonAttempt struct {
+	Event         string       `json:"event"`
+	Mode          string       `json:"mode"`
+	Target        string       `json:"target"`
+	Attempt       int          `json:"attempt"`
+	DurationMS    float64      `json:"duration_ms"`
+	Status        string       `json:"status"`
+	StatusCode    int          `json:"status_code,omitempty"`
+	ExitCode      int          `json:"exit_code"`
+	ErrorCategory string       `json:"error_category,omitempty"`
+	Error         string       `json:"error,omitempty"`
+	Timings       *jsonTimings `json:"timings,omitempty"`
+}
+
+// jsonTimings is the breakdown of the duration of an HTTP check.
+type jsonTimings struct {
+	ConnectMS         float64 `json:"connect_ms"`
+	TLSHandshakeMS    float64 `json:"tls_handshake_ms,omitempty"`
+	TimeToFirstByteMS float64 `json:"time_to_first_byte_ms"`
+	BodyReadMS        float64 `json:"body_read_ms"`
+}
+
+type jsonTransition struct {
+	Event  string   `json:"event"`
+	Mode   string   `json:"mode"`
+	Target string   `json:"target"`
+	From   string   `json:"from"`
+	To     []string `json:"to"`
+}
+
+type jsonSummary struct {
+	Event      string  `json:"event"`
+	Mode       string  `json:"mode"`
+	Target     string  `json:"target"`
+	Attempts   int     `json:"attempts"`
+	DurationMS float64 `json:"duration_ms"`
+	Status     string  `json:"status"`
+	ExitCode   int     `json:"exit_code"`
+	// DetailedExitCode is set when the process exits with another code than
+	// the detailed one, i.e. with docker exit codes.
+	DetailedExitCode int    `json:"detailed_exit_code,omitempty"`
+	ErrorCategory    string `json:"error_category,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// jsonObserver writes one JSON object per check and a final summary.
+type jsonObserver struct {
+	mode   string
+	target string
+
+	mu       sync.Mutex
+	encoder  *json.Encoder
+	attempts int
+}
+
+func newJSONObserver(w io.Writer, mode, target string) *jsonObserver {
+	return &jsonObserver{mode: mode, target: target, encoder: json.NewEncoder(w)}
+}
+
+func (o *jsonObserver) attempted(a attemptEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.attempts++
+
+	// #nosec G104 - there is nowhere left to report a failed write to
+	o.encoder.Encode(newJSONAttempt(a, o.target))
+}
+
+func newJSONAttempt(a attemptEvent, target string) jsonAttempt {
+	event := jsonAttempt{
+		Event:      "attempt",
+		Mode:       a.mode,
+		Target:     target,
+		Attempt:    a.attempt,
+		DurationMS: milliseconds(a.duration),
+		Status:     "success",
+	}
+	if a.err != nil {
+		message, code := describeFailure(a.err)
+		event.Status = "failure"
+		event.ExitCode = code
+		event.ErrorCategory = errorCategory(code)
+		event.Error = message
+		if hErr, ok := a.err.(healthcheck.HealthCheckError); ok {
+			event.StatusCode = hErr.StatusCode
+		}
+	}
+	if t := a.timings; t != nil {
+		event.Timings = &jsonTimings{
+			ConnectMS:         milliseconds(t.Connect),
+			TLSHandshakeMS:    milliseconds(t.TLSHandshake),
+			TimeToFirstByteMS: milliseconds(t.TimeToFirstByte),
+			BodyReadMS:        milliseconds(t.BodyRead),
+		}
+	}
+	return event
+}
+
+func (o *jsonObserver) transitioned(from string, to []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// #nosec G104 - there is nowhere left to report a failed write to
+	o.encoder.Encode(jsonTransition{Event: "transition", Mode: o.mode, Target: o.target, From: from, To: to})
+}
+
+func (o *jsonObserver) finished(code int, message string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	summary := jsonSummary{
+		Event:         "summary",
+		Mode:          o.mode,
+		Target:        o.target,
+		Attempts:      o.attempts,
+		DurationMS:    milliseconds(time.Since(started)),
+		Status:        "success",
+		ExitCode:      processExitCode(code),
+		ErrorCategory: errorCategory(code),
+		Error:         message,
+	}
+	if code != 0 {
+		summary.Status = "failure"
+	}
+	if summary.ExitCode != code {
+		summary.DetailedExitCode = code
+	}
+
+	// #nosec G104 - there is nowhere left to report a failed write to
+	o.encoder.Encode(summary)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
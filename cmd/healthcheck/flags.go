@@ -0,0 +1,31 @@
+package main
+
+import "flag"
+
+// applyFlagSources sets the flags that were not given on the command line
+// from the other sources of flag values. Each source only sets the flags that
+// no source applied before it set, so that from the highest precedence to the
+// lowest they are: the command line, HEALTHCHECK_* environment variables, the
+// config file and the probe file. It returns every problem found in the
+// sources.
+func applyFlagSources() []error {
+	problems := applyEnvironment()
+	if *configFile != "" {
+		problems = append(problems, applyConfigFile(*configFile)...)
+	}
+	if *probeFile != "" {
+		problems = append(problems, applyProbeFile(*probeFile)...)
+	}
+	return problems
+}
+
+// explicitFlags returns the names of the flags that have been set, either on
+// the command line or by the sources applyFlagSources applied so far, as
+// opposed to the flags left at their default.
+func explicitFlags() map[string]bool {
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
@@ -1,9 +1,15 @@
 package main_test
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync/atomic"
@@ -63,6 +69,53 @@ var _ = Describe("HealthCheck", func() {
 		})
 	})
 
+	Describe("fails when validating flags", func() {
+		itExitsWithUsageError := func(reason string, flags ...string) {
+			It("exits with code 2 and logs reason", func() {
+				session, err := gexec.Start(exec.Command(healthCheck, flags...), GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(2))
+				Expect(session.Err).To(gbytes.Say(reason))
+			})
+		}
+
+		Context("when several mode intervals are set", func() {
+			itExitsWithUsageError(
+				"conflicting modes: only one of -startup-interval, -liveness-interval may be set",
+				"-startup-interval=1s", "-liveness-interval=1s",
+			)
+		})
+
+		Context("when the startup timeout is set outside startup mode", func() {
+			itExitsWithUsageError(
+				"-startup-timeout is not relevant in liveness mode, only in startup, lifecycle modes",
+				"-liveness-interval=1s", "-startup-timeout=10s",
+			)
+		})
+
+		Context("when mode is set without an interval", func() {
+			itExitsWithUsageError("-mode=liveness requires -interval", "-mode=liveness")
+		})
+
+		Context("when mode is set along with a mode interval", func() {
+			itExitsWithUsageError(
+				"-mode conflicts with -readiness-interval, use -interval instead",
+				"-mode=liveness", "-interval=1s", "-readiness-interval=1s",
+			)
+		})
+
+		Context("when mode is invalid", func() {
+			itExitsWithUsageError(`invalid value "sometimes" for -mode`, "-mode=sometimes")
+		})
+
+		Context("when a dependency is set outside the readiness modes", func() {
+			itExitsWithUsageError(
+				"-dependency is not relevant in liveness mode, only in readiness, until-ready, lifecycle modes",
+				"-liveness-interval=1s", "-dependency=tcp:localhost:5432",
+			)
+		})
+	})
+
 	portHealthCheck := func() *gexec.Session {
 		return createPortHealthCheck(args, port)
 	}
@@ -78,7 +131,7 @@ var _ = Describe("HealthCheck", func() {
 		)
 
 		BeforeEach(func() {
-			statusCode = http.StatusInternalServerError
+			atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
 			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 				statusCode := atomic.LoadInt64(&statusCode)
 				resp.WriteHeader(int(statusCode))
@@ -106,11 +159,12 @@ var _ = Describe("HealthCheck", func() {
 				args = []string{"-startup-interval=1s", "-startup-timeout=60s"}
 			})
 
-			It("exits with healthcheck error when signalled", func() {
+			It("exits with the stopped code and a summary when signalled", func() {
 				session = httpHealthCheck()
 				Eventually(server.ReceivedRequests, 3*time.Second).Should(HaveLen(2))
 				session.Signal(syscall.SIGTERM)
-				Eventually(session).Should(gexec.Exit())
+				Eventually(session).Should(gexec.Exit(90))
+				Expect(session.Err).To(gbytes.Say(`Startup check stopped after 2 attempts \(uptime [0-9.]+m?s\), last check failed: .*received status code 500 in`))
 			})
 		})
 
@@ -128,6 +182,99 @@ var _ = Describe("HealthCheck", func() {
 			Eventually(session, 3*time.Second).Should(gexec.Exit(6))
 		})
 
+		Context("with a success threshold", func() {
+			BeforeEach(func() {
+				atomic.StoreInt64(&statusCode, http.StatusOK)
+				args = []string{"-startup-interval=100ms", "-success-threshold=3"}
+			})
+
+			It("exits once the check passes success-threshold consecutive times", func() {
+				session = httpHealthCheck()
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(server.ReceivedRequests()).To(HaveLen(3))
+			})
+		})
+
+		Context("with a failure threshold", func() {
+			BeforeEach(func() {
+				args = []string{"-startup-interval=100ms", "-failure-threshold=3"}
+			})
+
+			It("exits with healthcheck error once the check fails failure-threshold consecutive times", func() {
+				session = httpHealthCheck()
+				Eventually(session).Should(gexec.Exit(6))
+				Expect(server.ReceivedRequests()).To(HaveLen(3))
+				Expect(session.Err).To(gbytes.Say("Startup check unsuccessful after 3 consecutive failures"))
+			})
+		})
+
+		Context("with an exponential backoff", func() {
+			BeforeEach(func() {
+				args = []string{"-startup-interval=200ms", "-startup-timeout=60s", "-backoff-multiplier=2"}
+			})
+
+			It("grows the interval between checks", func() {
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests, 2*time.Second).Should(HaveLen(4))
+				Consistently(server.ReceivedRequests, time.Second).Should(HaveLen(4))
+			})
+
+			Context("with a max interval", func() {
+				BeforeEach(func() {
+					args = append(args, "-backoff-max-interval=400ms")
+				})
+
+				It("does not grow the interval beyond it", func() {
+					session = httpHealthCheck()
+					Eventually(server.ReceivedRequests, 2*time.Second).Should(HaveLen(5))
+				})
+			})
+		})
+
+		Context("with an initial delay", func() {
+			BeforeEach(func() {
+				args = []string{"-startup-interval=100ms", "-startup-timeout=500ms", "-initial-delay=1s"}
+			})
+
+			It("does not check until the initial delay has passed", func() {
+				session = httpHealthCheck()
+				Consistently(server.ReceivedRequests, 800*time.Millisecond).Should(BeEmpty())
+				Eventually(server.ReceivedRequests).ShouldNot(BeEmpty())
+			})
+
+			It("reports the initial delay separately from the startup-timeout", func() {
+				session = httpHealthCheck()
+				Eventually(session, 3*time.Second).Should(gexec.Exit(6))
+				Expect(session.Err).To(gbytes.Say(`Timed out after 500ms \([0-9]+ attempts, after an initial delay of 1s\)`))
+			})
+		})
+
+		Context("with log level info", func() {
+			BeforeEach(func() {
+				args = []string{"-startup-interval=100ms", "-log-level=info"}
+			})
+
+			It("logs the outcome and latency of every attempt", func() {
+				session = httpHealthCheck()
+				Eventually(session.Err).Should(gbytes.Say(`Startup check attempt 1 failed in [0-9.]+[µm]?s: failed to make HTTP request to '/api/_ping' on port [0-9]+: received status code 500`))
+				Eventually(session.Err).Should(gbytes.Say(`Startup check attempt 2 failed in`))
+				atomic.StoreInt64(&statusCode, http.StatusOK)
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say(`Startup check attempt [0-9]+ succeeded in`))
+			})
+		})
+
+		Context("with log level debug", func() {
+			BeforeEach(func() {
+				args = []string{"-startup-interval=100ms", "-log-level=debug"}
+			})
+
+			It("logs which interface address is checked", func() {
+				session = httpHealthCheck()
+				Eventually(session.Err).Should(gbytes.Say("selected address " + getNonLoopbackIP() + " of interface"))
+			})
+		})
+
 		Context("when startup timeout is set to 0", func() {
 			BeforeEach(func() {
 				args = []string{"-startup-interval=1s", "-startup-timeout=0s"}
@@ -163,7 +310,7 @@ var _ = Describe("HealthCheck", func() {
 		)
 
 		BeforeEach(func() {
-			statusCode = http.StatusInternalServerError
+			atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
 			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 				statusCode := atomic.LoadInt64(&statusCode)
 				resp.WriteHeader(int(statusCode))
@@ -216,7 +363,7 @@ var _ = Describe("HealthCheck", func() {
 		)
 
 		BeforeEach(func() {
-			statusCode = http.StatusOK
+			atomic.StoreInt64(&statusCode, http.StatusOK)
 			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 				statusCode := atomic.LoadInt64(&statusCode)
 				resp.WriteHeader(int(statusCode))
@@ -239,6 +386,234 @@ var _ = Describe("HealthCheck", func() {
 			Expect(session.Err).To(gbytes.Say("received status code 500 in"))
 		})
 
+		Context("with a failure threshold", func() {
+			BeforeEach(func() {
+				args = []string{"-liveness-interval=500ms", "-failure-threshold=3"}
+			})
+
+			It("does not exit until the check fails failure-threshold consecutive times", func() {
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests).ShouldNot(BeEmpty())
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Consistently(session, 900*time.Millisecond).ShouldNot(gexec.Exit())
+				Eventually(session, 2*time.Second).Should(gexec.Exit(6))
+				Expect(session.Err).To(gbytes.Say("Liveness check unsuccessful after 3 consecutive failures"))
+			})
+
+			It("resets the failure streak when the check passes", func() {
+				session = httpHealthCheck()
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(server.ReceivedRequests, 2*time.Second).Should(HaveLen(2))
+				atomic.StoreInt64(&statusCode, http.StatusOK)
+				Eventually(server.ReceivedRequests, 2*time.Second).Should(HaveLen(3))
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Consistently(session, 900*time.Millisecond).ShouldNot(gexec.Exit())
+			})
+
+			Context("with a success threshold", func() {
+				BeforeEach(func() {
+					var requests int64
+					server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+						if atomic.AddInt64(&requests, 1)%2 == 1 {
+							resp.WriteHeader(http.StatusInternalServerError)
+						}
+					}))
+					args = []string{"-liveness-interval=100ms", "-failure-threshold=3", "-success-threshold=2"}
+				})
+
+				It("resets the failure streak on any passing check", func() {
+					session = httpHealthCheck()
+					Eventually(server.ReceivedRequests, 2*time.Second).Should(HaveLen(5))
+					Consistently(session, 500*time.Millisecond).ShouldNot(gexec.Exit())
+				})
+			})
+		})
+
+		Context("with a metrics address", func() {
+			var metricsAddr string
+
+			getMetrics := func() string {
+				resp, err := http.Get("http://" + metricsAddr + "/metrics")
+				if err != nil {
+					return ""
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				return string(body)
+			}
+
+			BeforeEach(func() {
+				metricsAddr = freeLocalAddr()
+				args = []string{"-liveness-interval=100ms", "-failure-threshold=100", "-metrics-listen=" + metricsAddr}
+			})
+
+			It("serves metrics of the checks in the Prometheus format", func() {
+				session = httpHealthCheck()
+				Eventually(getMetrics).Should(ContainSubstring(`healthcheck_checks_total{mode="liveness",result="success",code="0"}`))
+				Expect(getMetrics()).To(ContainSubstring(`healthcheck_healthy{mode="liveness"} 1`))
+				Expect(getMetrics()).To(ContainSubstring(`healthcheck_check_duration_seconds_bucket{mode="liveness",le="+Inf"}`))
+				Expect(getMetrics()).To(ContainSubstring(`healthcheck_http_phase_duration_seconds_bucket{mode="liveness",phase="time_to_first_byte",le="+Inf"}`))
+
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(getMetrics).Should(ContainSubstring(`healthcheck_checks_total{mode="liveness",result="failure",code="6"}`))
+				Eventually(getMetrics).Should(MatchRegexp(`healthcheck_consecutive_failures{mode="liveness"} [2-9]`))
+				Expect(getMetrics()).To(ContainSubstring(`healthcheck_healthy{mode="liveness"} 0`))
+			})
+		})
+
+		Context("with a webhook URL", func() {
+			var (
+				receiver   *ghttp.Server
+				events     chan string
+				deliveries int64
+			)
+
+			BeforeEach(func() {
+				events = make(chan string, 10)
+				deliveries = 0
+				receiver = ghttp.NewServer()
+				receiver.RouteToHandler("POST", "/hook", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+					body, err := io.ReadAll(req.Body)
+					Expect(err).NotTo(HaveOccurred())
+					if atomic.AddInt64(&deliveries, 1) == 1 {
+						resp.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					events <- string(body)
+				}))
+				args = []string{"-liveness-interval=100ms", "-failure-threshold=3", "-webhook-url=" + receiver.URL() + "/hook"}
+			})
+
+			AfterEach(func() {
+				receiver.Close()
+			})
+
+			It("posts an event when the checks start failing, retrying failed deliveries", func() {
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests).Should(HaveLen(2))
+				Consistently(events, 200*time.Millisecond).ShouldNot(Receive())
+
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(session, 2*time.Second).Should(gexec.Exit(6))
+				var event string
+				Expect(events).To(Receive(&event))
+				Expect(event).To(ContainSubstring(`"event":"health_changed"`))
+				Expect(event).To(ContainSubstring(`"mode":"liveness","target":"http:` + port + `/api/_ping","from":"healthy","to":"unhealthy"`))
+				Expect(event).To(ContainSubstring(`"status_code":500`))
+				Expect(atomic.LoadInt64(&deliveries)).To(BeEquivalentTo(2))
+			})
+
+			It("posts an event when the checks pass again", func() {
+				args[1] = "-failure-threshold=100"
+				atomic.AddInt64(&deliveries, 1)
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests).Should(HaveLen(2))
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(events).Should(Receive(ContainSubstring(`"to":"unhealthy"`)))
+				atomic.StoreInt64(&statusCode, http.StatusOK)
+				Eventually(events).Should(Receive(ContainSubstring(`"from":"unhealthy","to":"healthy"`)))
+			})
+
+			It("posts an event when the first check fails", func() {
+				args[1] = "-failure-threshold=1"
+				atomic.AddInt64(&deliveries, 1)
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				session = httpHealthCheck()
+				Eventually(session, 2*time.Second).Should(gexec.Exit(6))
+				var event string
+				Expect(events).To(Receive(&event))
+				Expect(event).To(ContainSubstring(`"from":"unknown","to":"unhealthy"`))
+				Expect(event).To(ContainSubstring(`"attempt":1,`))
+			})
+		})
+
+		Context("when refreshing the interfaces", func() {
+			BeforeEach(func() {
+				args = []string{"-liveness-interval=100ms", "-interface-refresh-interval=1ns"}
+			})
+
+			It("keeps checking the same address", func() {
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests).Should(HaveLen(3))
+				Expect(session).NotTo(gexec.Exit())
+				Expect(session.Err).NotTo(gbytes.Say("Selected interface address changed"))
+			})
+		})
+
+		Context("with a failure window", func() {
+			BeforeEach(func() {
+				var requests int64
+				server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+					if atomic.AddInt64(&requests, 1)%2 == 0 {
+						resp.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					resp.WriteHeader(http.StatusOK)
+				}))
+
+				args = []string{"-liveness-interval=100ms", "-failure-window-size=4", "-failure-window-percent=40"}
+			})
+
+			It("exits once too many checks in the window fail", func() {
+				session = httpHealthCheck()
+				Eventually(session).Should(gexec.Exit(6))
+				Expect(server.ReceivedRequests()).To(HaveLen(4))
+				Expect(session.Err).To(gbytes.Say(`Liveness check unsuccessful, 2 of 4 checks failed in the last 4 attempts \(50.0%, more than 40.0% allowed\): `))
+				Expect(session.Err).To(gbytes.Say("received status code 500 in"))
+			})
+
+			Context("when the failure percentage is not exceeded", func() {
+				BeforeEach(func() {
+					args = []string{"-liveness-interval=100ms", "-failure-window-size=4", "-failure-window-percent=50"}
+				})
+
+				It("does not exit", func() {
+					session = httpHealthCheck()
+					Consistently(session).ShouldNot(gexec.Exit())
+				})
+			})
+		})
+
+		Context("when signalled", func() {
+			BeforeEach(func() {
+				if runtime.GOOS == "windows" {
+					Skip("skipping since SIGTERM probably doesn't work on Windows")
+				}
+			})
+
+			It("exits with the stopped code and a summary", func() {
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests).Should(HaveLen(1))
+				session.Signal(syscall.SIGTERM)
+				Eventually(session).Should(gexec.Exit(90))
+				Expect(session.Err).To(gbytes.Say(`Liveness check stopped after 1 attempts \(uptime [0-9.]+m?s\), last check passed`))
+			})
+
+			It("cancels the check in flight", func() {
+				server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+					<-req.Context().Done()
+				}))
+				args = []string{"-liveness-interval=1s", "-timeout=1m"}
+
+				session = httpHealthCheck()
+				Eventually(server.ReceivedRequests).Should(HaveLen(1))
+				session.Interrupt()
+				Eventually(session).Should(gexec.Exit(90))
+				Expect(session.Err).To(gbytes.Say("Liveness check stopped after 0 attempts .*, no check completed"))
+			})
+
+			It("names the mode when stopped during the initial delay", func() {
+				args = append(args, "-initial-delay=1m")
+
+				session = httpHealthCheck()
+				Consistently(session).ShouldNot(gexec.Exit())
+				session.Signal(syscall.SIGTERM)
+				Eventually(session).Should(gexec.Exit(90))
+				Expect(session.Err).To(gbytes.Say("Liveness check stopped after 0 attempts .*, no check completed"))
+			})
+		})
+
 		It("runs a healthcheck every liveness-interval", func() {
 			session = httpHealthCheck()
 			start := time.Now()
@@ -255,7 +630,7 @@ var _ = Describe("HealthCheck", func() {
 		)
 
 		BeforeEach(func() {
-			statusCode = http.StatusOK
+			atomic.StoreInt64(&statusCode, http.StatusOK)
 			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 				statusCode := atomic.LoadInt64(&statusCode)
 				resp.WriteHeader(int(statusCode))
@@ -278,49 +653,1108 @@ var _ = Describe("HealthCheck", func() {
 			Expect(session.Err).To(gbytes.Say("received status code 500 in"))
 		})
 
-		It("runs a healthcheck every readiness-interval", func() {
-			session = httpHealthCheck()
-			start := time.Now()
-			Eventually(server.ReceivedRequests, 3*time.Second).Should(HaveLen(2))
-			end := time.Now()
-			Expect(end.Sub(start)).To(BeNumerically("~", 1*time.Second, 100*time.Millisecond))
+		Context("when the mode is set explicitly", func() {
+			BeforeEach(func() {
+				args = []string{"-mode=readiness", "-interval=1s"}
+			})
+
+			It("does not exit until the http server is down", func() {
+				session = httpHealthCheck()
+				Consistently(session).ShouldNot(gexec.Exit())
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(session, 2*time.Second).Should(gexec.Exit(6))
+				Expect(session.Err).To(gbytes.Say("Readiness check unsuccessful"))
+			})
 		})
-	})
 
-	Describe("port healthcheck", func() {
-		Context("when the address is listening", func() {
-			itPasses(portHealthCheck)
+		Context("with dependencies", func() {
+			var dependency *ghttp.Server
+
+			BeforeEach(func() {
+				dependency = ghttp.NewServer()
+				dependency.RouteToHandler("GET", "/health", ghttp.RespondWith(http.StatusOK, ""))
+				args = append(args, "-dependency=http:"+dependency.Addr()+"/health", "-dependency-timeout=100ms")
+			})
+
+			AfterEach(func() {
+				dependency.Close()
+			})
+
+			It("does not exit until a critical dependency is down", func() {
+				session = httpHealthCheck()
+				Consistently(session).ShouldNot(gexec.Exit())
+				dependency.RouteToHandler("GET", "/health", ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+				Eventually(session, 2*time.Second).Should(gexec.Exit(6))
+				Expect(session.Err).To(gbytes.Say("Readiness check unsuccessful: dependency http:" + dependency.Addr() + "/health is down: failed to make HTTP request to '/health'"))
+				Expect(session.Err).To(gbytes.Say("received status code 503"))
+			})
+
+			Context("when an optional dependency is down", func() {
+				BeforeEach(func() {
+					args = append(args, "-optional-dependency=tcp:127.0.0.1:-1")
+				})
+
+				It("logs that the app is degraded and stays ready", func() {
+					session = httpHealthCheck()
+					Eventually(session.Err).Should(gbytes.Say("degraded, optional dependency tcp:127.0.0.1:-1 is down"))
+					Consistently(session, 1500*time.Millisecond).ShouldNot(gexec.Exit())
+				})
+			})
+
+			Context("when a dependency is invalid", func() {
+				BeforeEach(func() {
+					args = append(args, "-dependency=tcp:localhost")
+				})
+
+				It("exits with code 2", func() {
+					session = httpHealthCheck()
+					Eventually(session).Should(gexec.Exit(2))
+					Expect(session.Err).To(gbytes.Say(`invalid value "tcp:localhost" for -dependency: must name a host and a port`))
+				})
+			})
 		})
 
-		Context("when the address is not listening", func() {
+		Context("with a status address", func() {
+			var socketDir, socket string
+
+			getStatus := func() (int, string) {
+				client := http.Client{Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+					},
+				}}
+				resp, err := client.Get("http://healthcheck/status")
+				if err != nil {
+					return 0, ""
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+				return resp.StatusCode, string(body)
+			}
+
+			statusCodeOf := func() int {
+				code, _ := getStatus()
+				return code
+			}
+
 			BeforeEach(func() {
-				port = "-1"
+				var err error
+				socketDir, err = os.MkdirTemp("", "healthcheck-status")
+				Expect(err).NotTo(HaveOccurred())
+				socket = filepath.Join(socketDir, "status.sock")
+				args = []string{"-readiness-interval=100ms", "-failure-threshold=100", "-status-listen=unix:" + socket}
 			})
 
-			itExitsWithCode(portHealthCheck, 4, "dial tcp: address -1: invalid port")
+			AfterEach(func() {
+				os.RemoveAll(socketDir)
+			})
+
+			It("serves the latest status and the most recent checks as JSON", func() {
+				session = httpHealthCheck()
+				Eventually(statusCodeOf).Should(Equal(http.StatusOK))
+				_, body := getStatus()
+				Expect(body).To(ContainSubstring(`"status":"healthy","target":"http:` + port + `/api/_ping","modes":{"readiness":{"status":"healthy"`))
+				Expect(body).To(ContainSubstring(`"history":[{"time":`))
+
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(statusCodeOf).Should(Equal(http.StatusServiceUnavailable))
+				_, body = getStatus()
+				Expect(body).To(ContainSubstring(`"status":"unhealthy"`))
+				Expect(body).To(MatchRegexp(`"consecutive_failures":[1-9]`))
+				Expect(body).To(ContainSubstring(`"status_code":500`))
+			})
+
+			It("removes the socket when it exits", func() {
+				session = httpHealthCheck()
+				Eventually(socket).Should(BeAnExistingFile())
+				session.Signal(syscall.SIGTERM)
+				Eventually(session).Should(gexec.Exit(90))
+				Expect(socket).NotTo(BeAnExistingFile())
+			})
 		})
-	})
 
-	Describe("http healthcheck", func() {
-		Context("when the healthcheck is properly invoked", func() {
+		Context("with a status file", func() {
+			var statusDir, statusPath string
+
+			readStatus := func() string {
+				contents, err := os.ReadFile(statusPath)
+				if err != nil {
+					return ""
+				}
+				return string(contents)
+			}
+
 			BeforeEach(func() {
-				server.RouteToHandler("GET", "/api/_ping", ghttp.VerifyRequest("GET", "/api/_ping"))
+				var err error
+				statusDir, err = os.MkdirTemp("", "healthcheck-status")
+				Expect(err).NotTo(HaveOccurred())
+				statusPath = filepath.Join(statusDir, "status.json")
+				args = []string{"-readiness-interval=100ms", "-failure-threshold=100", "-status-file=" + statusPath}
 			})
 
-			Context("when the address is listening", func() {
-				itPasses(httpHealthCheck)
+			AfterEach(func() {
+				os.RemoveAll(statusDir)
 			})
 
-			Context("when the address returns error http code", func() {
-				BeforeEach(func() {
-					server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusInternalServerError, ""))
-				})
+			It("writes the latest status after every check", func() {
+				session = httpHealthCheck()
+				Eventually(readStatus).Should(ContainSubstring(`"status":"healthy","target":"http:` + port + `/api/_ping"`))
 
-				itExitsWithCode(httpHealthCheck, 6, "received status code 500 in")
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(readStatus).Should(ContainSubstring(`"status":"unhealthy"`))
+				Expect(readStatus()).To(ContainSubstring(`"status_code":500`))
+
+				entries, err := os.ReadDir(statusDir)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(HaveLen(1))
 			})
 		})
+
+		It("runs a healthcheck every readiness-interval", func() {
+			session = httpHealthCheck()
+			start := time.Now()
+			Eventually(server.ReceivedRequests, 3*time.Second).Should(HaveLen(2))
+			end := time.Now()
+			Expect(end.Sub(start)).To(BeNumerically("~", 1*time.Second, 100*time.Millisecond))
+		})
 	})
-})
+
+	Describe("in lifecycle mode", func() {
+		var (
+			session    *gexec.Session
+			statusCode int64
+		)
+
+		BeforeEach(func() {
+			atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				statusCode := atomic.LoadInt64(&statusCode)
+				resp.WriteHeader(int(statusCode))
+			}))
+
+			args = []string{"-lifecycle", "-startup-interval=100ms", "-startup-timeout=1s", "-liveness-interval=100ms"}
+		})
+
+		AfterEach(func() {
+			session.Kill()
+		})
+
+		It("exits with code 80 when the startup check does not pass", func() {
+			session = httpHealthCheck()
+			Eventually(session, 2*time.Second).Should(gexec.Exit(80))
+			Expect(session.Err).To(gbytes.Say("Timed out after 1s"))
+			Expect(session.Err).To(gbytes.Say("received status code 500 in"))
+		})
+
+		It("transitions to liveness once the startup check passes", func() {
+			session = httpHealthCheck()
+			Consistently(session).ShouldNot(gexec.Exit())
+			atomic.StoreInt64(&statusCode, http.StatusOK)
+			Eventually(session.Out).Should(gbytes.Say("Startup check passed, starting liveness checks"))
+			Consistently(session, 2*time.Second).ShouldNot(gexec.Exit())
+		})
+
+		It("exits with code 81 when the liveness check fails", func() {
+			atomic.StoreInt64(&statusCode, http.StatusOK)
+			session = httpHealthCheck()
+			Eventually(session.Out).Should(gbytes.Say("Startup check passed"))
+			atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+			Eventually(session).Should(gexec.Exit(81))
+			Expect(session.Err).To(gbytes.Say("Liveness check unsuccessful: "))
+		})
+
+		Context("when a readiness interval is set", func() {
+			BeforeEach(func() {
+				args = []string{"-lifecycle", "-startup-interval=100ms", "-liveness-interval=1h", "-readiness-interval=100ms"}
+			})
+
+			It("exits with code 82 when the readiness check fails", func() {
+				atomic.StoreInt64(&statusCode, http.StatusOK)
+				session = httpHealthCheck()
+				Eventually(session.Out).Should(gbytes.Say("Startup check passed, starting liveness and readiness checks"))
+				atomic.StoreInt64(&statusCode, http.StatusInternalServerError)
+				Eventually(session).Should(gexec.Exit(82))
+				Expect(session.Err).To(gbytes.Say("Readiness check unsuccessful: "))
+			})
+		})
+
+		Context("when the liveness interval is not set", func() {
+			BeforeEach(func() {
+				args = []string{"-lifecycle", "-startup-interval=100ms"}
+			})
+
+			It("exits with code 2", func() {
+				session = httpHealthCheck()
+				Eventually(session).Should(gexec.Exit(2))
+				Expect(session.Err).To(gbytes.Say("-lifecycle requires -startup-interval and -liveness-interval"))
+			})
+		})
+	})
+
+	Describe("with a config file", func() {
+		var (
+			configDir  string
+			configPath string
+		)
+
+		writeConfig := func(contents string) {
+			Expect(os.WriteFile(configPath, []byte(contents), 0644)).To(Succeed())
+		}
+
+		configHealthCheck := func(extraArgs ...string) *gexec.Session {
+			session, err := gexec.Start(exec.Command(healthCheck, append([]string{"-config", configPath}, extraArgs...)...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+
+		BeforeEach(func() {
+			var err error
+			configDir, err = os.MkdirTemp("", "healthcheck-config")
+			Expect(err).NotTo(HaveOccurred())
+			configPath = filepath.Join(configDir, "config.yml")
+
+			server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusOK, ""))
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(configDir)).To(Succeed())
+		})
+
+		It("reads JSON config files", func() {
+			writeConfig(`{"port": "` + port + `", "uri": "/api/_ping", "timeout": "100ms"}`)
+			session := configHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("reads YAML config files describing several checks", func() {
+			writeConfig(`
+timeout: 100ms
+require: all
+check:
+- type: http
+  port: ` + port + `
+  uri: /api/_ping
+- tcp:` + port + `
+`)
+			session := configHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("lets flags override the config file", func() {
+			writeConfig(`{"port": "-1", "timeout": "100ms"}`)
+			session := configHealthCheck("-port", port)
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		It("reports every problem at once", func() {
+			writeConfig(`
+bogus: true
+success-threshold: 0
+timeout: soon
+check:
+- type: udp
+  port: 9090
+`)
+			session := configHealthCheck()
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say(`invalid key "bogus"`))
+			Expect(session.Err).To(gbytes.Say(`invalid value "soon" for key "timeout"`))
+			Expect(session.Err).To(gbytes.Say(`unknown check type "udp"`))
+			Expect(session.Err).To(gbytes.Say(`invalid value 0 for -success-threshold`))
+		})
+
+		Context("when the config file does not exist", func() {
+			BeforeEach(func() {
+				configPath = filepath.Join(configDir, "missing.yml")
+			})
+
+			It("exits with code 2", func() {
+				session := configHealthCheck()
+				Eventually(session).Should(gexec.Exit(2))
+				Expect(session.Err).To(gbytes.Say("failed to read config file"))
+			})
+		})
+	})
+
+	Describe("with environment variables", func() {
+		envHealthCheck := func(env []string, args ...string) *gexec.Session {
+			command := exec.Command(healthCheck, args...)
+			command.Env = append(os.Environ(), env...)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusOK, ""))
+		})
+
+		It("sets flags from HEALTHCHECK_* environment variables", func() {
+			session := envHealthCheck([]string{"HEALTHCHECK_PORT=" + port, "HEALTHCHECK_URI=/api/_ping", "HEALTHCHECK_TIMEOUT=100ms"})
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("lets flags override environment variables", func() {
+			session := envHealthCheck([]string{"HEALTHCHECK_PORT=-1", "HEALTHCHECK_TIMEOUT=100ms"}, "-port", port)
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		It("reports invalid values", func() {
+			session := envHealthCheck([]string{"HEALTHCHECK_TIMEOUT=soon"})
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say(`invalid value "soon" for HEALTHCHECK_TIMEOUT`))
+		})
+
+		It("prints the effective configuration", func() {
+			session := envHealthCheck([]string{"HEALTHCHECK_LIVENESS_INTERVAL=10s", "HEALTHCHECK_CHECK=tcp:8080,tcp:9090"}, "-print-config", "-timeout", "2s")
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`check:\n\s*- tcp:8080\n\s*- tcp:9090\n`))
+			Expect(session.Out).To(gbytes.Say(`liveness-interval: 10s\n`))
+			Expect(session.Out).To(gbytes.Say(`timeout: 2s\n`))
+			Expect(server.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+
+	Describe("with a Kubernetes probe file", func() {
+		var (
+			probeDir  string
+			probePath string
+			request   *http.Request
+		)
+
+		writeProbe := func(contents string) {
+			Expect(os.WriteFile(probePath, []byte(contents), 0644)).To(Succeed())
+		}
+
+		probeHealthCheck := func(extraArgs ...string) *gexec.Session {
+			session, err := gexec.Start(exec.Command(healthCheck, append([]string{"-probe-file", probePath}, extraArgs...)...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+
+		BeforeEach(func() {
+			var err error
+			probeDir, err = os.MkdirTemp("", "healthcheck-probe")
+			Expect(err).NotTo(HaveOccurred())
+			probePath = filepath.Join(probeDir, "probe.yml")
+
+			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				request = req
+			}))
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(probeDir)).To(Succeed())
+		})
+
+		It("runs httpGet probes with their headers", func() {
+			writeProbe(`
+httpGet:
+  path: /api/_ping
+  port: ` + port + `
+  httpHeaders:
+  - name: X-Probe
+    value: liveness
+timeoutSeconds: 1
+`)
+			session := probeHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(request.Header.Get("X-Probe")).To(Equal("liveness"))
+		})
+
+		It("runs tcpSocket probes given as JSON", func() {
+			writeProbe(`{"tcpSocket": {"port": ` + port + `}}`)
+			session := probeHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		It("runs exec probes", func() {
+			writeProbe(`
+exec:
+  command: ["sh", "-c", "echo not ready; exit 3"]
+`)
+			session := probeHealthCheck()
+			Eventually(session).Should(gexec.Exit(9))
+			Expect(session.Err).To(gbytes.Say(`command "sh -c echo not ready; exit 3" failed: exit status 3: not ready`))
+		})
+
+		It("runs the probe every periodSeconds with its thresholds in long-running modes", func() {
+			writeProbe(`
+httpGet:
+  path: /api/_ping
+  port: ` + port + `
+periodSeconds: 1
+failureThreshold: 2
+initialDelaySeconds: 3
+`)
+			session := probeHealthCheck("-mode=liveness", "-print-config")
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`failure-threshold: "2"`))
+			Expect(session.Out).To(gbytes.Say(`initial-delay: 3s`))
+			Expect(session.Out).To(gbytes.Say(`interval: 1s`))
+		})
+
+		It("ignores the initial delay when running a single check", func() {
+			writeProbe(`
+tcpSocket:
+  port: ` + port + `
+initialDelaySeconds: 3
+`)
+			start := time.Now()
+			session := probeHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(time.Since(start)).To(BeNumerically("<", 3*time.Second))
+		})
+
+		Context("with docker exit codes", func() {
+			It("exits with code 1 when the probe fails", func() {
+				writeProbe(`{"tcpSocket": {"port": 1}}`)
+				session := probeHealthCheck("-exit-codes=docker")
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Err).To(gbytes.Say("failed to make TCP connection"))
+			})
+
+			It("reports the code it exits with in the JSON summary", func() {
+				writeProbe(`{"tcpSocket": {"port": 1}}`)
+				session := probeHealthCheck("-exit-codes=docker", "-output=json")
+				Eventually(session).Should(gexec.Exit(1))
+				Expect(session.Out).To(gbytes.Say(`"event":"summary".*"status":"failure","exit_code":1,"detailed_exit_code":4,"error_category":"tcp_connection"`))
+			})
+		})
+
+		It("rejects named ports", func() {
+			writeProbe(`{"httpGet": {"path": "/", "port": "http"}}`)
+			session := probeHealthCheck()
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say(`invalid httpGet port "http": must be a port number, named ports are not supported`))
+		})
+
+		Context("with a grpc probe", func() {
+			var (
+				grpcServer *httptest.Server
+				status     int
+			)
+
+			BeforeEach(func() {
+				status = 1
+			})
+
+			JustBeforeEach(func() {
+				grpcServer = newGRPCHealthServer(getNonLoopbackIP(), status)
+				_, grpcPort, err := net.SplitHostPort(grpcServer.Listener.Addr().String())
+				Expect(err).NotTo(HaveOccurred())
+				writeProbe(`{"grpc": {"port": ` + grpcPort + `}}`)
+			})
+
+			AfterEach(func() {
+				grpcServer.Close()
+			})
+
+			It("calls the gRPC health service", func() {
+				session := probeHealthCheck()
+				Eventually(session).Should(gexec.Exit(0))
+			})
+
+			Context("when the server is not serving", func() {
+				BeforeEach(func() {
+					status = 2
+				})
+
+				It("exits with code 11", func() {
+					session := probeHealthCheck()
+					Eventually(session).Should(gexec.Exit(11))
+					Expect(session.Err).To(gbytes.Say("reports the server as NOT_SERVING"))
+				})
+			})
+		})
+
+		It("rejects flags describing another check", func() {
+			writeProbe(`{"tcpSocket": {"port": ` + port + `}}`)
+			session := probeHealthCheck("-port", port)
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say("-port conflicts with -probe-file"))
+		})
+	})
+
+	Describe("port healthcheck", func() {
+		Context("when the address is listening", func() {
+			itPasses(portHealthCheck)
+		})
+
+		Context("when the address is not listening", func() {
+			BeforeEach(func() {
+				port = "-1"
+			})
+
+			itExitsWithCode(portHealthCheck, 4, "dial tcp: address -1: invalid port")
+		})
+
+		Context("with an initial delay", func() {
+			BeforeEach(func() {
+				args = []string{"-initial-delay=500ms"}
+			})
+
+			It("waits before checking", func() {
+				start := time.Now()
+				session := portHealthCheck()
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+			})
+		})
+	})
+
+	Describe("with a port mapping", func() {
+		var (
+			portsEnv string
+			env      []string
+		)
+
+		BeforeEach(func() {
+			env = nil
+		})
+
+		mappedHealthCheck := func() *gexec.Session {
+			command := exec.Command(healthCheck, append([]string{"-timeout", "100ms"}, args...)...)
+			command.Env = append(append(os.Environ(), "CF_INSTANCE_PORTS="+portsEnv), env...)
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			return session
+		}
+
+		Context("when the mapping is external", func() {
+			BeforeEach(func() {
+				portsEnv = `[{"internal":8080,"external":` + port + `,"internal_tls_proxy":61443,"external_tls_proxy":61002}]`
+				args = []string{"-port-mapping=external", "-port=8080"}
+			})
+
+			It("checks the external port", func() {
+				args = append(args, "-log-level=debug")
+				session := mappedHealthCheck()
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("CF_INSTANCE_PORTS maps internal port 8080 to external port " + port))
+			})
+		})
+
+		Context("when the mapping is internal", func() {
+			BeforeEach(func() {
+				portsEnv = `[{"internal":` + port + `,"external":61001}]`
+				args = []string{"-port-mapping=internal", "-port=" + port}
+			})
+
+			itPasses(mappedHealthCheck)
+		})
+
+		Context("when the port has no mapping", func() {
+			BeforeEach(func() {
+				portsEnv = `[{"internal":9090,"external":61001},{"internal":8081,"external":61002}]`
+				args = []string{"-port-mapping=external", "-port=8080"}
+			})
+
+			itExitsWithCode(mappedHealthCheck, 2, "port 8080 has no mapping in CF_INSTANCE_PORTS, which maps internal ports 8081, 9090")
+		})
+
+		Context("when CF_INSTANCE_PORTS is invalid", func() {
+			BeforeEach(func() {
+				portsEnv = `[{"internal":8080,`
+				args = []string{"-port-mapping=external", "-port=8080"}
+			})
+
+			itExitsWithCode(mappedHealthCheck, 2, "invalid CF_INSTANCE_PORTS")
+		})
+
+		Context("when a port is out of range", func() {
+			BeforeEach(func() {
+				portsEnv = `[{"internal":8080,"external":70000}]`
+				args = []string{"-port-mapping=external", "-port=8080"}
+			})
+
+			itExitsWithCode(mappedHealthCheck, 2, "entry 0 needs internal and external ports between 1 and 65535")
+		})
+
+		Context("when the mapping is invalid", func() {
+			BeforeEach(func() {
+				portsEnv = `[]`
+				args = []string{"-port-mapping=host", "-port=8080"}
+			})
+
+			itExitsWithCode(mappedHealthCheck, 2, `invalid value "host" for -port-mapping`)
+		})
+
+		Context("when built with the external tag", func() {
+			var externalHealthCheck string
+
+			BeforeEach(func() {
+				var err error
+				externalHealthCheck, err = gexec.Build("code.cloudfoundry.org/healthcheck/cmd/healthcheck", "-tags", "external")
+				Expect(err).NotTo(HaveOccurred())
+				portsEnv = `[{"internal":8080,"external":` + port + `}]`
+			})
+
+			externalBuildHealthCheck := func(flags ...string) *gexec.Session {
+				command := exec.Command(externalHealthCheck, append([]string{"-timeout", "100ms", "-log-level=debug"}, flags...)...)
+				command.Env = append(os.Environ(), "CF_INSTANCE_PORTS="+portsEnv)
+				session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				return session
+			}
+
+			It("checks the external port by default", func() {
+				session := externalBuildHealthCheck("-port=8080")
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("CF_INSTANCE_PORTS maps internal port 8080 to external port " + port))
+			})
+
+			It("checks ports without a mapping unmapped", func() {
+				portsEnv = `[]`
+				session := externalBuildHealthCheck("-port=" + port)
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Err).To(gbytes.Say("CF_INSTANCE_PORTS has no mapping for port " + port + ", checking it unmapped"))
+			})
+
+			It("checks ports unmapped when CF_INSTANCE_PORTS is not set", func() {
+				portsEnv = ""
+				session := externalBuildHealthCheck("-port=" + port)
+				Eventually(session).Should(gexec.Exit(0))
+			})
+
+			It("rejects a malformed CF_INSTANCE_PORTS", func() {
+				portsEnv = "not-json"
+				session := externalBuildHealthCheck("-port=" + port)
+				Eventually(session).Should(gexec.Exit(2))
+				Expect(session.Err).To(gbytes.Say(`invalid CF_INSTANCE_PORTS "not-json"`))
+			})
+
+			It("validates the mapping when -port-mapping is set", func() {
+				portsEnv = `[]`
+				session := externalBuildHealthCheck("-port-mapping=external", "-port="+port)
+				Eventually(session).Should(gexec.Exit(2))
+				Expect(session.Err).To(gbytes.Say("port " + port + " has no mapping in CF_INSTANCE_PORTS"))
+			})
+		})
+
+		Context("when the address is instance", func() {
+			BeforeEach(func() {
+				portsEnv = `[{"internal":8080,"external":` + port + `}]`
+				env = []string{"CF_INSTANCE_IP=" + getNonLoopbackIP()}
+				args = []string{"-address=instance", "-port-mapping=external", "-port=8080"}
+			})
+
+			itPasses(mappedHealthCheck)
+
+			Context("when the instance address is not listening", func() {
+				BeforeEach(func() {
+					env = []string{"CF_INSTANCE_IP=127.0.0.1"}
+				})
+
+				itExitsWithCode(mappedHealthCheck, 4, "failed to make TCP connection to 127.0.0.1:"+port)
+			})
+
+			Context("when only CF_INSTANCE_ADDR is set", func() {
+				BeforeEach(func() {
+					env = []string{"CF_INSTANCE_IP=", "CF_INSTANCE_ADDR=127.0.0.1:61001"}
+				})
+
+				itExitsWithCode(mappedHealthCheck, 4, "failed to make TCP connection to 127.0.0.1:"+port)
+			})
+
+			Context("when the address of the instance is not set", func() {
+				BeforeEach(func() {
+					env = []string{"CF_INSTANCE_IP=", "CF_INSTANCE_ADDR="}
+				})
+
+				itExitsWithCode(mappedHealthCheck, 2, "neither CF_INSTANCE_IP nor CF_INSTANCE_ADDR is set")
+			})
+
+			Context("when the ports are not mapped to external ports", func() {
+				BeforeEach(func() {
+					args = []string{"-address=instance", "-port-mapping=internal", "-port=8080"}
+				})
+
+				itExitsWithCode(mappedHealthCheck, 2, "-address=instance requires -port-mapping to be external or external-tls-proxy")
+			})
+		})
+
+		Context("when the mapping is external-tls-proxy", func() {
+			var tlsServer *httptest.Server
+
+			BeforeEach(func() {
+				listener, err := net.Listen("tcp", getNonLoopbackIP()+":0")
+				Expect(err).NotTo(HaveOccurred())
+
+				tlsServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path != "/health" {
+						w.WriteHeader(http.StatusNotFound)
+					}
+				}))
+				tlsServer.Listener = listener
+				tlsServer.StartTLS()
+
+				_, tlsPort, err := net.SplitHostPort(listener.Addr().String())
+				Expect(err).NotTo(HaveOccurred())
+				portsEnv = `[{"internal":8080,"external":` + port + `,"internal_tls_proxy":61443,"external_tls_proxy":` + tlsPort + `}]`
+				env = []string{"CF_INSTANCE_IP=" + getNonLoopbackIP()}
+				args = []string{"-address=instance", "-port-mapping=external-tls-proxy", "-port=8080", "-uri=/health"}
+			})
+
+			AfterEach(func() {
+				tlsServer.Close()
+			})
+
+			itPasses(mappedHealthCheck)
+
+			Context("when the port has no TLS proxy", func() {
+				BeforeEach(func() {
+					portsEnv = `[{"internal":8080,"external":` + port + `}]`
+				})
+
+				itExitsWithCode(mappedHealthCheck, 2, "port 8080 has no external_tls_proxy port in CF_INSTANCE_PORTS")
+			})
+		})
+	})
+
+	Describe("composite healthcheck", func() {
+		var closedPort string
+
+		compositeHealthCheck := func() *gexec.Session {
+			return createPortHealthCheck(args, port)
+		}
+
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusOK, ""))
+
+			listener, err := net.Listen("tcp", getNonLoopbackIP()+":0")
+			Expect(err).NotTo(HaveOccurred())
+			_, closedPort, err = net.SplitHostPort(listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(listener.Close()).To(Succeed())
+		})
+
+		Context("when all checks pass", func() {
+			BeforeEach(func() {
+				args = []string{"-check", "http:" + port + "/api/_ping", "-check", "tcp:" + port}
+			})
+
+			itPasses(compositeHealthCheck)
+		})
+
+		Context("when one of the checks fails", func() {
+			BeforeEach(func() {
+				args = []string{"-check", "http:" + port + "/api/_ping", "-check", "tcp:" + closedPort}
+			})
+
+			itExitsWithCode(compositeHealthCheck, 4, "1 of 2 checks passed, 2 required: tcp:[0-9]+: failed to make TCP connection")
+
+			Context("when any check is required", func() {
+				BeforeEach(func() {
+					args = append(args, "-require=any")
+				})
+
+				itPasses(compositeHealthCheck)
+			})
+		})
+
+		Context("when more checks are required than there are checks", func() {
+			BeforeEach(func() {
+				args = []string{"-check", "tcp:" + port, "-require=2"}
+			})
+
+			itExitsWithCode(compositeHealthCheck, 2, `invalid value "2" for -require: only 1 checks to run`)
+
+			Context("when port is a list", func() {
+				BeforeEach(func() {
+					args = []string{"-port", port + "," + port, "-require=3"}
+				})
+
+				itExitsWithCode(portHealthCheck, 2, `invalid value "3" for -require: only 2 checks to run`)
+			})
+		})
+
+		Context("when port is a list", func() {
+			Context("when every port is healthy", func() {
+				BeforeEach(func() {
+					args = []string{"-port", port + "," + port}
+				})
+
+				itPasses(httpHealthCheck)
+			})
+
+			Context("when one of the ports is unhealthy", func() {
+				BeforeEach(func() {
+					args = []string{"-port", port + "," + closedPort}
+				})
+
+				itExitsWithCode(portHealthCheck, 4, "1 of 2 checks passed, 2 required: port [0-9]+: failed to make TCP connection")
+			})
+
+			Context("when a uri is given per port", func() {
+				BeforeEach(func() {
+					server.RouteToHandler("GET", "/other", ghttp.RespondWith(http.StatusInternalServerError, ""))
+					args = []string{"-port", port + "," + port, "-uri", "/api/_ping,/other"}
+				})
+
+				itExitsWithCode(httpHealthCheck, 6, "port [0-9]+: failed to make HTTP request to '/other'")
+			})
+
+			Context("when the number of uris does not match the number of ports", func() {
+				BeforeEach(func() {
+					args = []string{"-port", port + "," + port + "," + port, "-uri", "/api/_ping,/other"}
+				})
+
+				itExitsWithCode(httpHealthCheck, 2, "expected 1 or 3 URIs")
+			})
+		})
+
+		Context("when a single port is checked on a uri containing commas", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.RawQuery != "a=1,2" {
+						w.WriteHeader(http.StatusBadRequest)
+					}
+				})
+				args = []string{"-uri", "/api/_ping?a=1,2"}
+			})
+
+			itPasses(httpHealthCheck)
+		})
+
+		Context("when a check is invalid", func() {
+			BeforeEach(func() {
+				args = []string{"-check", "udp:" + port}
+			})
+
+			itExitsWithCode(compositeHealthCheck, 2, "unknown check type")
+		})
+	})
+
+	Describe("json output", func() {
+		BeforeEach(func() {
+			args = []string{"-output=json"}
+		})
+
+		Context("when the check passes", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusOK, ""))
+			})
+
+			It("writes the breakdown of the duration of the HTTP check", func() {
+				session := httpHealthCheck()
+				Eventually(session).Should(gexec.Exit(0))
+				Expect(session.Out).To(gbytes.Say(
+					`{"event":"attempt","mode":"once","target":"http:` + port + `/api/_ping","attempt":1,"duration_ms":[0-9.]+,"status":"success","exit_code":0,"timings":{"connect_ms":[0-9.]+,"time_to_first_byte_ms":[0-9.]+,"body_read_ms":[0-9.]+}}\n`,
+				))
+			})
+		})
+
+		Context("when the check fails", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusInternalServerError, ""))
+			})
+
+			It("writes the attempt and a summary as JSON", func() {
+				session := httpHealthCheck()
+				Eventually(session).Should(gexec.Exit(6))
+				Expect(session.Out).To(gbytes.Say(
+					`{"event":"attempt","mode":"once","target":"http:` + port + `/api/_ping","attempt":1,"duration_ms":[0-9.]+,"status":"failure","status_code":500,"exit_code":6,"error_category":"http_status","error":"failed to make HTTP request to '/api/_ping' on port ` + port + `: received status code 500 in [0-9]+ms","timings":{"connect_ms":[0-9.]+,"time_to_first_byte_ms":[0-9.]+,"body_read_ms":[0-9.]+}}\n`,
+				))
+				Expect(session.Out).To(gbytes.Say(
+					`{"event":"summary","mode":"once","target":"http:` + port + `/api/_ping","attempts":1,"duration_ms":[0-9.]+,"status":"failure","exit_code":6,"error_category":"http_status","error":"failed to make HTTP request`,
+				))
+				Expect(session.Err).To(gbytes.Say("received status code 500 in"))
+			})
+		})
+
+		Context("in liveness mode", func() {
+			var statusCode int64
+
+			BeforeEach(func() {
+				atomic.StoreInt64(&statusCode, http.StatusOK)
+				server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+					resp.WriteHeader(int(atomic.LoadInt64(&statusCode)))
+				}))
+				args = append(args, "-liveness-interval=100ms")
+			})
+
+			It("writes one JSON object per attempt", func() {
+				session := portHealthCheck()
+				defer session.Kill()
+				Eventually(session.Out).Should(gbytes.Say(`{"event":"attempt","mode":"liveness","target":"tcp:` + port + `","attempt":1,"duration_ms":[0-9.]+,"status":"success","exit_code":0}\n`))
+				Eventually(session.Out).Should(gbytes.Say(`{"event":"attempt","mode":"liveness","target":"tcp:` + port + `","attempt":2,`))
+			})
+		})
+
+		Context("when the output format is invalid", func() {
+			BeforeEach(func() {
+				args = []string{"-output=xml"}
+			})
+
+			itExitsWithCode(portHealthCheck, 2, `invalid value "xml" for -output`)
+		})
+	})
+
+	Describe("tracing", func() {
+		var (
+			collector   *ghttp.Server
+			exports     chan []byte
+			traceParent string
+		)
+
+		BeforeEach(func() {
+			exports = make(chan []byte, 10)
+			collector = ghttp.NewServer()
+			collector.RouteToHandler("POST", "/v1/traces", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				body, err := io.ReadAll(req.Body)
+				Expect(err).NotTo(HaveOccurred())
+				exports <- body
+			}))
+			server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				traceParent = req.Header.Get("traceparent")
+			}))
+			args = []string{"-otlp-endpoint=" + collector.URL()}
+		})
+
+		AfterEach(func() {
+			collector.Close()
+		})
+
+		It("exports a span of the probe to the collector before exiting", func() {
+			session := httpHealthCheck()
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(exports).To(HaveLen(1))
+
+			var request struct {
+				ResourceSpans []struct {
+					ScopeSpans []struct {
+						Spans []struct {
+							TraceID string `json:"traceId"`
+							SpanID  string `json:"spanId"`
+							Name    string `json:"name"`
+							Events  []struct {
+								Name string `json:"name"`
+							} `json:"events"`
+							Status struct {
+								Code int `json:"code"`
+							} `json:"status"`
+						} `json:"spans"`
+					} `json:"scopeSpans"`
+				} `json:"resourceSpans"`
+			}
+			Expect(json.Unmarshal(<-exports, &request)).To(Succeed())
+			Expect(request.ResourceSpans).To(HaveLen(1))
+			Expect(request.ResourceSpans[0].ScopeSpans).To(HaveLen(1))
+			spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+			Expect(spans).To(HaveLen(1))
+
+			span := spans[0]
+			Expect(span.Name).To(Equal("http healthcheck"))
+			Expect(span.Status.Code).To(Equal(1))
+			events := []string{}
+			for _, e := range span.Events {
+				events = append(events, e.Name)
+			}
+			Expect(events).To(ContainElements("connect_start", "connect_done", "first_response_byte"))
+			Expect(traceParent).To(Equal("00-" + span.TraceID + "-" + span.SpanID + "-01"))
+		})
+
+		Context("when the check fails", func() {
+			BeforeEach(func() {
+				port = "-1"
+			})
+
+			It("exports a span with an error status", func() {
+				session := portHealthCheck()
+				Eventually(session).Should(gexec.Exit(4))
+				Expect(exports).To(Receive(ContainSubstring(`"status":{"code":2,"message":"failed to make TCP connection`)))
+			})
+		})
+
+		Context("when the endpoint is invalid", func() {
+			BeforeEach(func() {
+				args = []string{"-otlp-endpoint=localhost:4318"}
+			})
+
+			itExitsWithCode(portHealthCheck, 2, `invalid value "localhost:4318" for -otlp-endpoint`)
+		})
+	})
+
+	Describe("tls certificate healthcheck", func() {
+		var tlsServer *httptest.Server
+
+		tlsHealthCheck := func() *gexec.Session {
+			_, tlsPort, err := net.SplitHostPort(tlsServer.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			return createPortHealthCheck(args, tlsPort)
+		}
+
+		BeforeEach(func() {
+			listener, err := net.Listen("tcp", getNonLoopbackIP()+":0")
+			Expect(err).NotTo(HaveOccurred())
+
+			tlsServer = httptest.NewUnstartedServer(http.NotFoundHandler())
+			tlsServer.Listener = listener
+			tlsServer.StartTLS()
+
+			args = []string{"-tls-cert"}
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		Context("when the certificate is valid", func() {
+			itPasses(tlsHealthCheck)
+		})
+
+		Context("when the certificate expires within the expiry window", func() {
+			BeforeEach(func() {
+				args = append(args, "-tls-cert-expiry-window=1000000h")
+			})
+
+			itExitsWithCode(tlsHealthCheck, 8, "within the 1000000h0m0s expiry window")
+		})
+	})
+
+	Describe("http healthcheck", func() {
+		Context("when the healthcheck is properly invoked", func() {
+			BeforeEach(func() {
+				server.RouteToHandler("GET", "/api/_ping", ghttp.VerifyRequest("GET", "/api/_ping"))
+			})
+
+			Context("when the address is listening", func() {
+				itPasses(httpHealthCheck)
+			})
+
+			Context("when the address returns error http code", func() {
+				BeforeEach(func() {
+					server.RouteToHandler("GET", "/api/_ping", ghttp.RespondWith(http.StatusInternalServerError, ""))
+				})
+
+				itExitsWithCode(httpHealthCheck, 6, "received status code 500 in")
+			})
+
+			Context("when the handler is too slow to respond", func() {
+				BeforeEach(func() {
+					server.RouteToHandler("GET", "/api/_ping", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+						time.Sleep(500 * time.Millisecond)
+					}))
+				})
+
+				itExitsWithCode(httpHealthCheck, 65, `timed out after 0.10 seconds \(connect [0-9.]+ms, no response received\)`)
+			})
+		})
+	})
+})
+
+func freeLocalAddr() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	defer listener.Close()
+	return listener.Addr().String()
+}
 
 func getNonLoopbackIP() string {
 	interfaces, err := net.Interfaces()
@@ -1,9 +1,10 @@
-//go:build !external
-// +build !external
-
 package main_test
 
 import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os/exec"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -30,3 +31,26 @@ func createPortHealthCheck(args []string, port string) *gexec.Session {
 	Expect(err).NotTo(HaveOccurred())
 	return session
 }
+
+// newGRPCHealthServer serves the gRPC health service on ip, reporting the
+// server as a whole with status.
+func newGRPCHealthServer(ip string, status int) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, err := io.ReadAll(req.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		resp.Header().Set("Content-Type", "application/grpc")
+		resp.Header().Set("Trailer", "Grpc-Status")
+		_, err = resp.Write([]byte{0, 0, 0, 0, 2, 0x08, byte(status)})
+		Expect(err).NotTo(HaveOccurred())
+		resp.Header().Set("Grpc-Status", "0")
+	}))
+
+	listener, err := net.Listen("tcp", ip+":0")
+	Expect(err).NotTo(HaveOccurred())
+	server.Listener = listener
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
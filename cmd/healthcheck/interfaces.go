@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+// interfaceSource hands out the network interfaces to check. When
+// refreshInterval is set, the interfaces are re-enumerated at most every
+// refreshInterval, so that long-running modes notice when the container's
+// address changes.
+type interfaceSource struct {
+	refreshInterval time.Duration
+
+	// enumerate, lookupAddress and logf are net.Interfaces,
+	// healthcheck.InterfaceAddress and logf, unless replaced in tests.
+	enumerate     func() ([]net.Interface, error)
+	lookupAddress func(interfaces []net.Interface) (string, bool)
+	logf          func(level logLevel, format string, args ...interface{})
+
+	mu         sync.Mutex
+	interfaces []net.Interface
+	address    string
+	refreshed  time.Time
+}
+
+func newInterfaceSource(refreshInterval time.Duration) (*interfaceSource, error) {
+	s := &interfaceSource{
+		refreshInterval: refreshInterval,
+		enumerate:       net.Interfaces,
+		lookupAddress:   healthcheck.InterfaceAddress,
+		logf:            logf,
+	}
+
+	interfaces, err := s.enumerate()
+	if err != nil {
+		return nil, err
+	}
+	s.interfaces = interfaces
+	s.address, _ = s.lookupAddress(interfaces)
+	s.refreshed = time.Now()
+	return s, nil
+}
+
+// get returns the interfaces to check along with ctx. When the interfaces
+// have just been re-enumerated, ctx carries the address looked up to notice
+// changes, so that the checks do not look it up again.
+func (s *interfaceSource) get(ctx context.Context) (context.Context, []net.Interface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refreshInterval <= 0 || time.Since(s.refreshed) < s.refreshInterval {
+		return ctx, s.interfaces
+	}
+
+	s.refreshed = time.Now()
+	interfaces, err := s.enumerate()
+	if err != nil {
+		s.logf(warnLevel, "Warning: failed refreshing interfaces, keeping the previous ones: %s", err)
+		return ctx, s.interfaces
+	}
+	s.interfaces = interfaces
+
+	address, _ := s.lookupAddress(interfaces)
+	s.logf(debugLevel, "re-enumerated %d interfaces, selected address %q", len(interfaces), address)
+	if address != s.address {
+		s.logf(warnLevel, "Selected interface address changed from %q to %q", s.address, address)
+		s.address = address
+	}
+
+	return healthcheck.WithInterfaceAddress(ctx, address), s.interfaces
+}
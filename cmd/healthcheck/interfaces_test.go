@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("interfaceSource", func() {
+	var (
+		source       *interfaceSource
+		enumerations int
+		enumerateErr error
+		address      string
+		messages     []string
+	)
+
+	BeforeEach(func() {
+		enumerations = 0
+		enumerateErr = nil
+		address = "10.0.0.1"
+		messages = nil
+
+		source = &interfaceSource{
+			refreshInterval: time.Nanosecond,
+			enumerate: func() ([]net.Interface, error) {
+				if enumerateErr != nil {
+					return nil, enumerateErr
+				}
+				enumerations++
+				// The index matches no interface, so that looking up its
+				// addresses fails.
+				return []net.Interface{{Index: 1<<20 + enumerations, Name: fmt.Sprintf("eth%d", enumerations)}}, nil
+			},
+			lookupAddress: func([]net.Interface) (string, bool) {
+				return address, address != ""
+			},
+			logf: func(_ logLevel, format string, args ...interface{}) {
+				messages = append(messages, fmt.Sprintf(format, args...))
+			},
+			interfaces: []net.Interface{{Name: "eth0"}},
+			address:    "10.0.0.1",
+			refreshed:  time.Now(),
+		}
+	})
+
+	It("re-enumerates the interfaces once the refresh interval has passed", func() {
+		_, interfaces := source.get(context.Background())
+		Expect(interfaces).To(ConsistOf(HaveField("Name", "eth1")))
+
+		_, interfaces = source.get(context.Background())
+		Expect(interfaces).To(ConsistOf(HaveField("Name", "eth2")))
+		Expect(enumerations).To(Equal(2))
+	})
+
+	It("logs when the selected address changes", func() {
+		source.get(context.Background())
+		Expect(messages).NotTo(ContainElement(HavePrefix("Selected interface address changed")))
+
+		address = "10.0.0.2"
+		source.get(context.Background())
+		Expect(messages).To(ContainElement(`Selected interface address changed from "10.0.0.1" to "10.0.0.2"`))
+	})
+
+	It("hands the address it looked up to the checks", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		address = "127.0.0.1"
+		ctx, interfaces := source.get(context.Background())
+		h := healthcheck.NewHealthCheck("tcp", "", port, time.Second)
+		Expect(h.CheckInterfacesContext(ctx, interfaces)).To(Succeed())
+	})
+
+	Context("when enumerating the interfaces fails", func() {
+		BeforeEach(func() {
+			enumerateErr = errors.New("boom")
+		})
+
+		It("keeps the previous interfaces", func() {
+			_, interfaces := source.get(context.Background())
+			Expect(interfaces).To(ConsistOf(HaveField("Name", "eth0")))
+			Expect(messages).To(ContainElement("Warning: failed refreshing interfaces, keeping the previous ones: boom"))
+		})
+	})
+
+	Context("when the refresh interval has not passed", func() {
+		BeforeEach(func() {
+			source.refreshInterval = time.Hour
+		})
+
+		It("keeps the interfaces and leaves looking up the address to the checks", func() {
+			ctx, interfaces := source.get(context.Background())
+			Expect(ctx).To(Equal(context.Background()))
+			Expect(interfaces).To(ConsistOf(HaveField("Name", "eth0")))
+			Expect(enumerations).To(BeZero())
+		})
+	})
+})
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+type logLevel int
+
+const (
+	errorLevel logLevel = iota
+	warnLevel
+	infoLevel
+	debugLevel
+)
+
+// currentLogLevel is set from -log-level. Failures are always logged.
+var currentLogLevel = warnLevel
+
+func parseLogLevel(level string) (logLevel, error) {
+	switch level {
+	case "error":
+		return errorLevel, nil
+	case "warn":
+		return warnLevel, nil
+	case "info":
+		return infoLevel, nil
+	case "debug":
+		return debugLevel, nil
+	}
+	return 0, fmt.Errorf("invalid value %q for -log-level: must be error, warn, info or debug", level)
+}
+
+func logf(level logLevel, format string, args ...interface{}) {
+	if level > currentLogLevel {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func debugf(format string, args ...interface{}) {
+	logf(debugLevel, format, args...)
+}
+
+// logObserver logs the outcome and latency of every check at info level.
+type logObserver struct{}
+
+func (logObserver) attempted(a attemptEvent) {
+	latency := a.duration.Round(time.Microsecond)
+	if a.err != nil {
+		message, _ := describeFailure(a.err)
+		logf(infoLevel, "%s check attempt %d failed in %s: %s", capitalize(a.mode), a.attempt, latency, message)
+		return
+	}
+	logf(infoLevel, "%s check attempt %d succeeded in %s", capitalize(a.mode), a.attempt, latency)
+}
+
+func (logObserver) transitioned(string, []string) {}
+
+func (logObserver) finished(int, string) {}
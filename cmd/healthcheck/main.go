@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/healthcheck"
@@ -19,13 +21,13 @@ var network = flag.String(
 var uri = flag.String(
 	"uri",
 	"",
-	"uri to healthcheck",
+	"uri to healthcheck. When port is a list, either a single uri used for every port or a comma separated list with one uri per port",
 )
 
 var port = flag.String(
 	"port",
 	"8080",
-	"port to healthcheck",
+	"port to healthcheck. May be a comma separated list, in which case every port is checked in parallel",
 )
 
 var timeout = flag.Duration(
@@ -34,6 +36,64 @@ var timeout = flag.Duration(
 	"dial timeout",
 )
 
+var portMappingFlag = flag.String(
+	"port-mapping",
+	"none",
+	"none, internal, external or external-tls-proxy. Unless none, every port to check must be an internal port of CF_INSTANCE_PORTS. With external the port it is mapped to on the host is checked instead, and with external-tls-proxy the port of the TLS proxy in front of it, over HTTPS for HTTP checks",
+)
+
+var addressFlag = flag.String(
+	"address",
+	"interface",
+	"interface or instance. With instance, checks the address of the instance on the host, CF_INSTANCE_IP or CF_INSTANCE_ADDR, instead of the address of the network interfaces. Requires port-mapping to be external or external-tls-proxy",
+)
+
+var tlsCert = flag.Bool(
+	"tls-cert",
+	false,
+	"if set, completes a TLS handshake against the port instead of a TCP or HTTP check and fails if the certificate is expired, not yet valid or expires within tls-cert-expiry-window",
+)
+
+var tlsCertExpiryWindow = flag.Duration(
+	"tls-cert-expiry-window",
+	0,
+	"Only relevant if tls-cert is set. The healthcheck fails if the certificate expires within this window",
+)
+
+var checks checkSpecs
+
+var require = flag.String(
+	"require",
+	"all",
+	"Only relevant if check is set or port is a list. Number of checks that must pass: all, any or a positive number",
+)
+
+func init() {
+	flag.Var(
+		&checks,
+		"check",
+		"check to run instead of the one described by port, uri and tls-cert, of the form tcp:PORT, tls:PORT or http:PORT/URI. May be repeated, checks run in parallel",
+	)
+}
+
+var initialDelay = flag.Duration(
+	"initial-delay",
+	0,
+	"delay before the first check, honored by every mode. In startup mode the startup-timeout starts after the initial delay",
+)
+
+var modeFlag = flag.String(
+	"mode",
+	"",
+	"alternative to the interval flags, one of once, startup, liveness, readiness, until-ready or lifecycle. Checks run every interval, except in lifecycle mode which uses the startup, liveness and readiness intervals",
+)
+
+var interval = flag.Duration(
+	"interval",
+	0,
+	"Only relevant if mode is set. Runs checks every interval",
+)
+
 var startupInterval = flag.Duration(
 	"startup-interval",
 	0,
@@ -64,99 +124,306 @@ var untilReadyInterval = flag.Duration(
 	"if set, starts the healthcheck in until-ready mode, i.e. do not exit until the healthcheck passes and the app is ready to serve traffic. runs checks every until-ready-interval",
 )
 
+var backoffMultiplier = flag.Float64(
+	"backoff-multiplier",
+	1,
+	"Only relevant in startup and until-ready modes. Factor the interval between checks grows by after every check, starting from the startup-interval or until-ready-interval",
+)
+
+var backoffMaxInterval = flag.Duration(
+	"backoff-max-interval",
+	0,
+	"Only relevant in startup and until-ready modes. When set to a non-zero value, the interval between checks does not grow beyond it",
+)
+
+var backoffJitter = flag.Float64(
+	"backoff-jitter",
+	0,
+	"Only relevant in startup and until-ready modes. Fraction between 0 and 1 by which every interval between checks is randomly lengthened or shortened",
+)
+
+var lifecycle = flag.Bool(
+	"lifecycle",
+	false,
+	"if set along with startup-interval and liveness-interval, runs the startup check until it passes and then the liveness check, and the readiness check if readiness-interval is set, in the same process. Exits with a code identifying the stage that failed",
+)
+
+var failureThreshold = flag.Int(
+	"failure-threshold",
+	0,
+	"number of consecutive failed checks after which the healthcheck exits unsuccessfully. Defaults to 1 in liveness and readiness modes unless a failure window is configured. In startup and until-ready modes 0 means keep retrying until the check passes or the startup-timeout is hit",
+)
+
+var successThreshold = flag.Int(
+	"success-threshold",
+	1,
+	"number of consecutive successful checks required before the startup and until-ready modes exit successfully. As in Kubernetes, any successful check resets a streak of failed checks",
+)
+
+var failureWindowSize = flag.Int(
+	"failure-window-size",
+	0,
+	"Only relevant in liveness and readiness modes. Number of most recent checks considered by failure-window-percent",
+)
+
+var failureWindowDuration = flag.Duration(
+	"failure-window-duration",
+	0,
+	"Only relevant in liveness and readiness modes. Only checks within this duration are considered by failure-window-percent",
+)
+
+var failureWindowPercent = flag.Float64(
+	"failure-window-percent",
+	0,
+	"Only relevant in liveness and readiness modes. If set along with failure-window-size or failure-window-duration, the healthcheck exits unsuccessfully when more than this percentage of the checks in the window failed",
+)
+
+var interfaceRefreshInterval = flag.Duration(
+	"interface-refresh-interval",
+	0,
+	"if set, re-enumerates the network interfaces before a check when they were last enumerated longer than this ago. Set it below the mode's interval to re-enumerate before every check",
+)
+
+var configFile = flag.String(
+	"config",
+	"",
+	"path to a YAML or JSON file setting flags, keyed by flag name. Flags given on the command line or as HEALTHCHECK_* environment variables override the file",
+)
+
+var probeFile = flag.String(
+	"probe-file",
+	"",
+	"path to a YAML or JSON Kubernetes probe definition with an httpGet, tcpSocket, grpc or exec handler to run instead of the check described by port, uri and check. Its timing fields set the matching flags unless they are set otherwise",
+)
+
+var exitCodes = flag.String(
+	"exit-codes",
+	"detailed",
+	"detailed or docker. With docker, every failure exits with code 1 as Docker HEALTHCHECK commands are expected to",
+)
+
+var output = flag.String(
+	"output",
+	"text",
+	"output format, text or json. With json, one JSON object per check and a final summary are written to stdout",
+)
+
+var logLevelFlag = flag.String(
+	"log-level",
+	"warn",
+	"one of error, warn, info or debug. info logs the outcome and latency of every check, debug additionally logs which interface address is checked and how ports are mapped",
+)
+
+var metricsListen = flag.String(
+	"metrics-listen",
+	"",
+	"if set, serves metrics of the checks in the Prometheus text format on this address at /metrics. Not relevant when running a single check",
+)
+
+var statusListen = flag.String(
+	"status-listen",
+	"",
+	"if set, serves the latest status of the checks and the most recent checks as JSON on this address at /status, either HOST:PORT or unix:PATH for a unix socket. Not relevant when running a single check",
+)
+
+var statusFile = flag.String(
+	"status-file",
+	"",
+	"if set, atomically writes the latest status of the checks and the most recent checks as JSON to this path after every check. Not relevant when running a single check",
+)
+
+var webhookURL = flag.String(
+	"webhook-url",
+	"",
+	"if set, posts a JSON event to this URL whenever the checks of a mode change from passing to failing or back. Not relevant when running a single check",
+)
+
+var webhookRetries = flag.Int(
+	"webhook-retries",
+	3,
+	"Only relevant if webhook-url is set. Number of times the delivery of an event is retried",
+)
+
+var otlpEndpoint = flag.String(
+	"otlp-endpoint",
+	"",
+	"if set, exports a span for every probe to this OpenTelemetry collector using OTLP over HTTP, e.g. http://localhost:4318, and sends a traceparent header with HTTP checks",
+)
+
+var printConfigFlag = flag.Bool(
+	"print-config",
+	false,
+	"if set, prints the effective configuration, after applying the config file and HEALTHCHECK_* environment variables, and exits",
+)
+
 func main() {
 	flag.Parse()
 
-	interfaces, err := net.Interfaces()
+	problems := applyFlagSources()
+	selected, validationProblems := validateFlags()
+	problems = append(problems, validationProblems...)
+
+	if *printConfigFlag {
+		if err := printConfig(); err != nil {
+			problems = append(problems, err)
+		}
+		if len(problems) == 0 {
+			exit(0)
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "%s\n", problem)
+		}
+		flag.Usage()
+		exit(2)
+		return
+	}
+
+	currentLogLevel, _ = parseLogLevel(*logLevelFlag)
+
+	interfaces, err := newInterfaceSource(*interfaceRefreshInterval)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to get interfaces: %s\n", err)
-		os.Exit(1)
+		exit(1)
 		return
 	}
 
-	h := newHealthCheck(*network, *uri, *port, *timeout)
+	var tracer *otlpTracer
+	if *otlpEndpoint != "" {
+		tracer = newOTLPTracer(*otlpEndpoint)
+		probeTracer = tracer
+	}
 
-	var timeoutTimerCh <-chan time.Time
-	if duration := *startupTimeout; duration > 0 {
-		timeoutTimerCh = time.NewTimer(duration).C
+	h, err := newChecker()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		flag.Usage()
+		exit(2)
+		return
 	}
 
-	if startupInterval != nil && *startupInterval > 0 {
-		ticker := time.NewTicker(*startupInterval)
-		defer ticker.Stop()
-		errCh := make(chan error)
-
-		for attempt := 1; ; attempt++ {
-			go func() {
-				err = h.CheckInterfaces(interfaces)
-				errCh <- err
-			}()
-
-			select {
-			case err = <-errCh:
-				if err == nil {
-					os.Exit(0)
-				}
-			case <-timeoutTimerCh:
-				fmt.Fprintf(os.Stderr, "Timed out after %s (%d attempts) waiting for startup check to succeed: ", *startupTimeout, attempt)
-				failHealthCheck(err)
-			}
+	observers = append(observers, logObserver{})
+	if *output == "json" {
+		observers = append(observers, newJSONObserver(os.Stdout, selected, describeTarget()))
+	} else {
+		observers = append(observers, &textObserver{w: os.Stdout})
+	}
 
-			select {
-			case <-ticker.C:
-			case <-timeoutTimerCh:
-				fmt.Fprintf(os.Stderr, "Timed out after %s (%d attempts) waiting for startup check to succeed: ", *startupTimeout, attempt)
-				failHealthCheck(err)
-			}
+	if *metricsListen != "" {
+		metrics := newMetricsObserver()
+		err = serveMetrics(*metricsListen, metrics)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to serve metrics on %s: %s\n", *metricsListen, err)
+			exit(1)
+			return
 		}
+		observers = append(observers, metrics)
 	}
 
-	if livenessInterval != nil && *livenessInterval > 0 {
-		for {
-			err = h.CheckInterfaces(interfaces)
+	if *statusListen != "" || *statusFile != "" {
+		status := newStatusObserver(describeTarget(), *statusFile)
+		if *statusListen != "" {
+			err = serveStatus(*statusListen, status)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Liveness check unsuccessful: ")
-				failHealthCheck(err)
+				fmt.Fprintf(os.Stderr, "Failed to serve status on %s: %s\n", *statusListen, err)
+				exit(1)
+				return
 			}
-			time.Sleep(*livenessInterval)
 		}
+		observers = append(observers, status)
 	}
 
-	if readinessInterval != nil && *readinessInterval > 0 {
-		for {
-			err = h.CheckInterfaces(interfaces)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Readiness check unsuccessful: ")
-				failHealthCheck(err)
-			}
-			time.Sleep(*readinessInterval)
+	if *webhookURL != "" {
+		observers = append(observers, newWebhookObserver(*webhookURL, describeTarget(), *webhookRetries))
+	}
+
+	if tracer != nil {
+		observers = append(observers, tracer)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if *initialDelay > 0 {
+		select {
+		case <-time.After(*initialDelay):
+		case <-ctx.Done():
+			failHealthCheck(stoppedError{capitalize(selected), 0, nil, time.Since(started)})
 		}
 	}
 
-	if untilReadyInterval != nil && *untilReadyInterval > 0 {
-		for {
-			err = h.CheckInterfaces(interfaces)
-			if err == nil {
-				os.Exit(0)
-			}
-			time.Sleep(*untilReadyInterval)
+	var timeoutTimerCh <-chan time.Time
+	if duration := *startupTimeout; duration > 0 && (selected == startupMode || selected == lifecycleMode) {
+		timeoutTimerCh = time.NewTimer(duration).C
+	}
+
+	// ready checks the dependencies of the app along with the app in the
+	// modes checking whether the app is ready.
+	ready := withDependencies(h)
+
+	var m *mode
+	switch selected {
+	case lifecycleMode:
+		runLifecycle(ctx, h, ready, interfaces, timeoutTimerCh)
+	case startupMode:
+		m = &mode{name: "Startup", interval: modeInterval(*startupInterval), exitOnPass: true}
+	case livenessMode:
+		m = &mode{name: "Liveness", interval: modeInterval(*livenessInterval)}
+	case readinessMode:
+		m = &mode{name: "Readiness", interval: modeInterval(*readinessInterval)}
+		h = ready
+	case untilReadyMode:
+		m = &mode{name: "Until-ready", interval: modeInterval(*untilReadyInterval), exitOnPass: true}
+		h = ready
+	}
+
+	if m != nil {
+		err = runMode(ctx, h, interfaces, *m, timeoutTimerCh)
+		if err == nil {
+			finish(0, "")
 		}
+		failHealthCheck(err)
 	}
 
-	err = h.CheckInterfaces(interfaces)
+	checkStarted := time.Now()
+	timingsCtx, timings := withAttemptTimings(ctx)
+	err = h.CheckInterfacesContext(interfaces.get(timingsCtx))
+	notifyAttempt(attemptEvent{mode: onceMode, attempt: 1, duration: time.Since(checkStarted), err: err, timings: timings.of(err)})
 	if err == nil {
-		os.Exit(0)
+		finish(0, "")
 	}
 
 	failHealthCheck(err)
 }
 
+// modeInterval returns the interval of the selected mode, given by -interval
+// when the mode is selected by -mode.
+func modeInterval(modeSpecificInterval time.Duration) time.Duration {
+	if *modeFlag != "" {
+		return *interval
+	}
+	return modeSpecificInterval
+}
+
 func failHealthCheck(err error) {
-	if err, ok := err.(healthcheck.HealthCheckError); ok {
-		fmt.Fprintf(os.Stderr, "%s\n", err.Message)
-		os.Exit(err.Code)
+	message, code := describeFailure(err)
+	finish(code, message)
+}
+
+// describeFailure returns the message to print and the code to exit with for
+// an error returned by a check or a mode.
+func describeFailure(err error) (string, int) {
+	switch err := err.(type) {
+	case stoppedError:
+		return err.Error(), stoppedCode
+	case modeError:
+		message, code := describeFailure(err.err)
+		return err.prefix + message, code
+	case healthcheck.HealthCheckError:
+		return err.Message, err.Code
 	}
 
-	fmt.Fprintf(os.Stderr, "Unknown error encountered in healthcheck: %s\n", err.Error())
-	os.Exit(127)
+	return fmt.Sprintf("Unknown error encountered in healthcheck: %s", err.Error()), 127
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the
+// check latency histogram.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type checkCounterKey struct {
+	mode   string
+	result string
+	code   int
+}
+
+type httpPhaseKey struct {
+	mode  string
+	phase string
+}
+
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// write writes the samples of the histogram named name, labelled with labels.
+func (h *latencyHistogram) write(w io.Writer, name, labels string) {
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// metricsObserver serves the results of the checks in the Prometheus text
+// exposition format.
+type metricsObserver struct {
+	mu                  sync.Mutex
+	checks              map[checkCounterKey]uint64
+	latencies           map[string]*latencyHistogram
+	httpPhases          map[httpPhaseKey]*latencyHistogram
+	consecutiveFailures map[string]int
+	healthy             map[string]bool
+}
+
+func newMetricsObserver() *metricsObserver {
+	return &metricsObserver{
+		checks:              map[checkCounterKey]uint64{},
+		latencies:           map[string]*latencyHistogram{},
+		httpPhases:          map[httpPhaseKey]*latencyHistogram{},
+		consecutiveFailures: map[string]int{},
+		healthy:             map[string]bool{},
+	}
+}
+
+// serveMetrics serves the metrics on address until the process exits.
+func serveMetrics(address string, o *metricsObserver) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", o)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		logf(warnLevel, "Warning: stopped serving metrics: %s", err)
+	}()
+	return nil
+}
+
+func (o *metricsObserver) attempted(a attemptEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := checkCounterKey{mode: a.mode, result: "success"}
+	if a.err != nil {
+		_, key.code = describeFailure(a.err)
+		key.result = "failure"
+		o.consecutiveFailures[a.mode]++
+	} else {
+		o.consecutiveFailures[a.mode] = 0
+	}
+	o.checks[key]++
+	o.healthy[a.mode] = a.err == nil
+
+	h, ok := o.latencies[a.mode]
+	if !ok {
+		h = newLatencyHistogram()
+		o.latencies[a.mode] = h
+	}
+	h.observe(a.duration)
+
+	if t := a.timings; t != nil {
+		for _, phase := range []struct {
+			name     string
+			duration time.Duration
+		}{
+			{"connect", t.Connect},
+			{"tls_handshake", t.TLSHandshake},
+			{"time_to_first_byte", t.TimeToFirstByte},
+			{"body_read", t.BodyRead},
+		} {
+			if phase.duration <= 0 {
+				continue
+			}
+			key := httpPhaseKey{mode: a.mode, phase: phase.name}
+			if o.httpPhases[key] == nil {
+				o.httpPhases[key] = newLatencyHistogram()
+			}
+			o.httpPhases[key].observe(phase.duration)
+		}
+	}
+}
+
+func (o *metricsObserver) transitioned(string, []string) {}
+
+func (o *metricsObserver) finished(int, string) {}
+
+func (o *metricsObserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintf(w, "# HELP healthcheck_checks_total Number of checks run, by result and exit code.\n")
+	fmt.Fprintf(w, "# TYPE healthcheck_checks_total counter\n")
+	keys := make([]checkCounterKey, 0, len(o.checks))
+	for key := range o.checks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mode != keys[j].mode {
+			return keys[i].mode < keys[j].mode
+		}
+		if keys[i].result != keys[j].result {
+			return keys[i].result < keys[j].result
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "healthcheck_checks_total{mode=%q,result=%q,code=\"%d\"} %d\n", key.mode, key.result, key.code, o.checks[key])
+	}
+
+	modes := make([]string, 0, len(o.latencies))
+	for mode := range o.latencies {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+
+	fmt.Fprintf(w, "# HELP healthcheck_check_duration_seconds Latency of the checks.\n")
+	fmt.Fprintf(w, "# TYPE healthcheck_check_duration_seconds histogram\n")
+	for _, mode := range modes {
+		o.latencies[mode].write(w, "healthcheck_check_duration_seconds", fmt.Sprintf("mode=%q", mode))
+	}
+
+	phases := make([]httpPhaseKey, 0, len(o.httpPhases))
+	for key := range o.httpPhases {
+		phases = append(phases, key)
+	}
+	sort.Slice(phases, func(i, j int) bool {
+		if phases[i].mode != phases[j].mode {
+			return phases[i].mode < phases[j].mode
+		}
+		return phases[i].phase < phases[j].phase
+	})
+
+	fmt.Fprintf(w, "# HELP healthcheck_http_phase_duration_seconds Duration of the phases of the HTTP checks: connect, tls_handshake, time_to_first_byte and body_read.\n")
+	fmt.Fprintf(w, "# TYPE healthcheck_http_phase_duration_seconds histogram\n")
+	for _, key := range phases {
+		o.httpPhases[key].write(w, "healthcheck_http_phase_duration_seconds", fmt.Sprintf("mode=%q,phase=%q", key.mode, key.phase))
+	}
+
+	fmt.Fprintf(w, "# HELP healthcheck_consecutive_failures Number of consecutive failed checks.\n")
+	fmt.Fprintf(w, "# TYPE healthcheck_consecutive_failures gauge\n")
+	for _, mode := range modes {
+		fmt.Fprintf(w, "healthcheck_consecutive_failures{mode=%q} %d\n", mode, o.consecutiveFailures[mode])
+	}
+
+	fmt.Fprintf(w, "# HELP healthcheck_healthy Whether the last check passed.\n")
+	fmt.Fprintf(w, "# TYPE healthcheck_healthy gauge\n")
+	for _, mode := range modes {
+		healthy := 0
+		if o.healthy[mode] {
+			healthy = 1
+		}
+		fmt.Fprintf(w, "healthcheck_healthy{mode=%q} %d\n", mode, healthy)
+	}
+}
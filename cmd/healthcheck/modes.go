@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+// Exit codes of the lifecycle mode, identifying the stage that failed.
+const (
+	startupStageFailed   = 80
+	livenessStageFailed  = 81
+	readinessStageFailed = 82
+)
+
+// stoppedCode is the exit code when the healthcheck is stopped by SIGTERM or
+// SIGINT, as opposed to exiting because the app is unhealthy.
+const stoppedCode = 90
+
+// started is when the healthcheck process started, reported as its uptime
+// when it is stopped.
+var started = time.Now()
+
+type mode struct {
+	name     string
+	interval time.Duration
+	// exitOnPass is set for the startup and until-ready modes, which exit
+	// once the check passes rather than once it fails.
+	exitOnPass bool
+}
+
+// modeError is returned by runMode when a mode gives up. The prefix describes
+// why and is printed ahead of the error of the last failed check.
+type modeError struct {
+	prefix string
+	err    error
+}
+
+func (e modeError) Error() string {
+	return e.prefix + e.err.Error()
+}
+
+// stoppedError is returned by runMode when the healthcheck is stopped by a
+// signal. It summarizes the checks run so far.
+type stoppedError struct {
+	name     string
+	attempts int
+	lastErr  error
+	uptime   time.Duration
+}
+
+func (e stoppedError) Error() string {
+	lastResult := "no check completed"
+	if e.attempts > 0 {
+		lastResult = "last check passed"
+		if e.lastErr != nil {
+			lastResult = "last check failed: " + e.lastErr.Error()
+		}
+	}
+
+	return fmt.Sprintf(
+		"%s check stopped after %d attempts (uptime %s), %s",
+		e.name,
+		e.attempts,
+		e.uptime.Round(time.Millisecond),
+		lastResult,
+	)
+}
+
+// runMode runs the check every interval. It returns nil once the check passes
+// in modes that exit on pass, a modeError once the mode gives up and a
+// stoppedError once ctx is done.
+func runMode(ctx context.Context, h healthcheck.Checker, interfaces *interfaceSource, m mode, timeoutTimerCh <-chan time.Time) error {
+	w := newSlidingWindow(*failureWindowSize, *failureWindowDuration, *failureWindowPercent)
+	failure := *failureThreshold
+	if !m.exitOnPass && !w.enabled() && failure < 1 {
+		failure = 1
+	}
+	t := newThresholds(failure, *successThreshold)
+
+	b := newBackoff(m.interval, 1, 0, 0)
+	if m.exitOnPass {
+		b = newBackoff(m.interval, *backoffMultiplier, *backoffMaxInterval, *backoffJitter)
+	}
+	errCh := make(chan error, 1)
+
+	var err, lastErr error
+	for attempt := 1; ; attempt++ {
+		nextCheck := time.NewTimer(b.next())
+
+		checkStarted := time.Now()
+		timingsCtx, timings := withAttemptTimings(ctx)
+		checkCtx, cancel := context.WithCancel(timingsCtx)
+		checkCtx, checkInterfaces := interfaces.get(checkCtx)
+		go func() {
+			errCh <- h.CheckInterfacesContext(checkCtx, checkInterfaces)
+		}()
+
+		select {
+		case err = <-errCh:
+			cancel()
+		case <-timeoutTimerCh:
+			cancel()
+			return startupTimeoutError(attempt, lastErr)
+		case <-ctx.Done():
+			cancel()
+			return stoppedError{m.name, attempt - 1, err, time.Since(started)}
+		}
+
+		notifyAttempt(attemptEvent{mode: strings.ToLower(m.name), attempt: attempt, duration: time.Since(checkStarted), err: err, timings: timings.of(err)})
+		if err != nil {
+			lastErr = err
+		}
+
+		t.record(err)
+		if m.exitOnPass && t.passed() {
+			return nil
+		}
+		if t.failed() {
+			if t.failure > 1 {
+				return modeError{fmt.Sprintf("%s check unsuccessful after %d consecutive failures: ", m.name, t.consecutiveFailures), err}
+			}
+			return modeError{fmt.Sprintf("%s check unsuccessful: ", m.name), err}
+		}
+
+		if !m.exitOnPass {
+			now := time.Now()
+			w.record(now, err)
+			if w.failed(now) {
+				return modeError{fmt.Sprintf("%s check unsuccessful, %s: ", m.name, w), lastErr}
+			}
+		}
+
+		select {
+		case <-nextCheck.C:
+		case <-timeoutTimerCh:
+			return startupTimeoutError(attempt, lastErr)
+		case <-ctx.Done():
+			nextCheck.Stop()
+			return stoppedError{m.name, attempt, err, time.Since(started)}
+		}
+	}
+}
+
+func startupTimeoutError(attempt int, err error) error {
+	if err == nil {
+		err = healthcheck.HealthCheckError{Code: 127, Message: "no check completed"}
+	}
+
+	if *initialDelay > 0 {
+		return modeError{fmt.Sprintf("Timed out after %s (%d attempts, after an initial delay of %s) waiting for startup check to succeed: ", *startupTimeout, attempt, *initialDelay), err}
+	}
+	return modeError{fmt.Sprintf("Timed out after %s (%d attempts) waiting for startup check to succeed: ", *startupTimeout, attempt), err}
+}
+
+// runLifecycle runs the startup check until it passes and then monitors the
+// liveness check, and the readiness check if a readiness interval is set, in
+// parallel. The readiness stage runs ready, which also checks the dependencies
+// of the app. It notifies the observers of every transition and exits with a
+// code identifying the stage that failed.
+func runLifecycle(ctx context.Context, h, ready healthcheck.Checker, interfaces *interfaceSource, timeoutTimerCh <-chan time.Time) {
+	err := runMode(ctx, h, interfaces, mode{name: "Startup", interval: *startupInterval, exitOnPass: true}, timeoutTimerCh)
+	if err != nil {
+		failStage(startupStageFailed, err)
+	}
+
+	stages := []string{livenessMode}
+	if *readinessInterval > 0 {
+		stages = append(stages, readinessMode)
+	}
+	notifyTransition(startupMode, stages)
+
+	type stageFailure struct {
+		code int
+		err  error
+	}
+	failed := make(chan stageFailure, 2)
+	go func() {
+		err := runMode(ctx, h, interfaces, mode{name: "Liveness", interval: *livenessInterval}, nil)
+		failed <- stageFailure{livenessStageFailed, err}
+	}()
+	if *readinessInterval > 0 {
+		go func() {
+			err := runMode(ctx, ready, interfaces, mode{name: "Readiness", interval: *readinessInterval}, nil)
+			failed <- stageFailure{readinessStageFailed, err}
+		}()
+	}
+
+	f := <-failed
+	failStage(f.code, f.err)
+}
+
+func failStage(code int, err error) {
+	message, errCode := describeFailure(err)
+	if errCode == stoppedCode {
+		code = stoppedCode
+	}
+	finish(code, message)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+// Values of -port-mapping.
+const (
+	noPortMapping               = "none"
+	internalPortMapping         = "internal"
+	externalPortMapping         = "external"
+	externalTLSProxyPortMapping = "external-tls-proxy"
+)
+
+// portMapping is an entry of CF_INSTANCE_PORTS, mapping a port of the
+// container to the port of the host it is reachable on, directly and through
+// the TLS proxy when one is configured.
+type portMapping struct {
+	Internal         int `json:"internal"`
+	External         int `json:"external"`
+	InternalTLSProxy int `json:"internal_tls_proxy"`
+	ExternalTLSProxy int `json:"external_tls_proxy"`
+}
+
+// portMappings are parsed from CF_INSTANCE_PORTS by validatePortMapping
+// unless -port-mapping is none.
+var portMappings []portMapping
+
+// lenientPortMapping is set by builds with the external tag, which default
+// -port-mapping to external. Unless -port-mapping is set, they check ports
+// that CF_INSTANCE_PORTS does not map unmapped, as they did before the flag
+// existed.
+var lenientPortMapping bool
+
+// parsePortMappings parses the value of CF_INSTANCE_PORTS, e.g.
+// [{"internal":8080,"external":61001,"internal_tls_proxy":61443,"external_tls_proxy":61002}].
+func parsePortMappings(value string) ([]portMapping, error) {
+	if value == "" {
+		return nil, fmt.Errorf("CF_INSTANCE_PORTS is not set")
+	}
+
+	var mappings []portMapping
+	err := json.Unmarshal([]byte(value), &mappings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CF_INSTANCE_PORTS %q: %s", value, err)
+	}
+
+	validPort := func(port int) bool {
+		return port > 0 && port <= 65535
+	}
+	for i, m := range mappings {
+		switch {
+		case !validPort(m.Internal) || !validPort(m.External):
+			return nil, fmt.Errorf("invalid CF_INSTANCE_PORTS %q: entry %d needs internal and external ports between 1 and 65535", value, i)
+		case m.InternalTLSProxy != 0 && !validPort(m.InternalTLSProxy), m.ExternalTLSProxy != 0 && !validPort(m.ExternalTLSProxy):
+			return nil, fmt.Errorf("invalid CF_INSTANCE_PORTS %q: entry %d has a TLS proxy port outside 1 to 65535", value, i)
+		}
+	}
+	return mappings, nil
+}
+
+// validatePortMapping checks the value of -port-mapping and, unless it is
+// none, CF_INSTANCE_PORTS, which must map every port to check unless the
+// mapping is lenient.
+func validatePortMapping(ports []string) []error {
+	switch *portMappingFlag {
+	case noPortMapping:
+		return nil
+	case internalPortMapping, externalPortMapping, externalTLSProxyPortMapping:
+	default:
+		return []error{fmt.Errorf("invalid value %q for -port-mapping: must be none, internal, external or external-tls-proxy", *portMappingFlag)}
+	}
+
+	lenient := lenientPortMapping && !explicitFlags()["port-mapping"]
+
+	// Lenient builds check every port unmapped when CF_INSTANCE_PORTS is not
+	// set, as when it maps none of them, but report it when it is malformed.
+	value := os.Getenv("CF_INSTANCE_PORTS")
+	if value == "" && lenient {
+		return nil
+	}
+	mappings, err := parsePortMappings(value)
+	if err != nil {
+		return []error{err}
+	}
+	portMappings = mappings
+
+	problems := []error{}
+	for _, p := range ports {
+		m, ok := lookupPortMapping(p)
+		switch {
+		case !ok && !lenient:
+			problems = append(problems, fmt.Errorf("port %s has no mapping in CF_INSTANCE_PORTS, which maps internal ports %s", p, internalPorts()))
+		case ok && *portMappingFlag == externalTLSProxyPortMapping && m.ExternalTLSProxy == 0:
+			problems = append(problems, fmt.Errorf("port %s has no external_tls_proxy port in CF_INSTANCE_PORTS, the TLS proxy may not be enabled", p))
+		}
+	}
+	return problems
+}
+
+func lookupPortMapping(port string) (portMapping, bool) {
+	for _, m := range portMappings {
+		if strconv.Itoa(m.Internal) == port {
+			return m, true
+		}
+	}
+	return portMapping{}, false
+}
+
+func internalPorts() string {
+	ports := []int{}
+	for _, m := range portMappings {
+		ports = append(ports, m.Internal)
+	}
+	sort.Ints(ports)
+
+	names := []string{}
+	for _, p := range ports {
+		names = append(names, strconv.Itoa(p))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// mapPort returns the port to check for the internal port, i.e. its external
+// port when -port-mapping is external, or the external port of the TLS proxy
+// in front of it when -port-mapping is external-tls-proxy. The mapping has
+// been validated by validatePortMapping, unless it is lenient.
+func mapPort(port string) string {
+	m, ok := lookupPortMapping(port)
+	if !ok {
+		if *portMappingFlag != noPortMapping && *portMappingFlag != internalPortMapping {
+			debugf("CF_INSTANCE_PORTS has no mapping for port %s, checking it unmapped", port)
+		}
+		return port
+	}
+
+	switch *portMappingFlag {
+	case externalPortMapping:
+		debugf("CF_INSTANCE_PORTS maps internal port %s to external port %d", port, m.External)
+		return strconv.Itoa(m.External)
+	case externalTLSProxyPortMapping:
+		debugf("CF_INSTANCE_PORTS maps internal port %s to external TLS proxy port %d", port, m.ExternalTLSProxy)
+		return strconv.Itoa(m.ExternalTLSProxy)
+	}
+	return port
+}
+
+// viaTLSProxy reports whether the checks go through the TLS proxy, in which
+// case HTTP checks are made over HTTPS.
+func viaTLSProxy() bool {
+	return *portMappingFlag == externalTLSProxyPortMapping
+}
+
+func newHealthCheck(
+	network, uri, port string,
+	timeout time.Duration,
+) healthcheck.HealthCheck {
+	if uri != "" && viaTLSProxy() {
+		return healthcheck.NewHTTPSHealthCheck(network, uri, mapPort(port), timeout)
+	}
+	return healthcheck.NewHealthCheck(network, uri, mapPort(port), timeout)
+}
+
+func newTLSHealthCheck(
+	network, port string,
+	timeout, expiryWindow time.Duration,
+) healthcheck.HealthCheck {
+	return healthcheck.NewTLSHealthCheck(network, mapPort(port), timeout, expiryWindow)
+}
@@ -0,0 +1,16 @@
+//go:build external
+// +build external
+
+package main
+
+import "flag"
+
+// Builds with the external tag check the external ports by default, as they
+// did before -port-mapping existed.
+func init() {
+	f := flag.Lookup("port-mapping")
+	f.DefValue = externalPortMapping
+	// #nosec G104 - external is a valid value of -port-mapping
+	f.Value.Set(externalPortMapping)
+	lenientPortMapping = true
+}
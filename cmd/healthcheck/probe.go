@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+	"gopkg.in/yaml.v3"
+)
+
+// kubernetesProbe is a Kubernetes probe definition, e.g. the value of the
+// livenessProbe of a container. Exactly one handler must be set.
+type kubernetesProbe struct {
+	HTTPGet   *httpGetAction   `yaml:"httpGet"`
+	TCPSocket *tcpSocketAction `yaml:"tcpSocket"`
+	GRPC      *grpcAction      `yaml:"grpc"`
+	Exec      *execAction      `yaml:"exec"`
+
+	InitialDelaySeconds *int `yaml:"initialDelaySeconds"`
+	PeriodSeconds       *int `yaml:"periodSeconds"`
+	TimeoutSeconds      *int `yaml:"timeoutSeconds"`
+	FailureThreshold    *int `yaml:"failureThreshold"`
+	SuccessThreshold    *int `yaml:"successThreshold"`
+}
+
+type httpGetAction struct {
+	Path        string `yaml:"path"`
+	Port        string `yaml:"port"`
+	Host        string `yaml:"host"`
+	Scheme      string `yaml:"scheme"`
+	HTTPHeaders []struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	} `yaml:"httpHeaders"`
+}
+
+type tcpSocketAction struct {
+	Port string `yaml:"port"`
+	Host string `yaml:"host"`
+}
+
+type grpcAction struct {
+	Port    string `yaml:"port"`
+	Service string `yaml:"service"`
+}
+
+type execAction struct {
+	Command []string `yaml:"command"`
+}
+
+// defaultPeriodSeconds is the period of Kubernetes probes that do not set
+// periodSeconds.
+const defaultPeriodSeconds = 10
+
+// probe is read from -probe-file.
+var probe *kubernetesProbe
+
+// probeFlags are the flags describing the check, which conflict with a probe
+// file.
+var probeFlags = []string{"check", "port", "uri", "tls-cert", "tls-cert-expiry-window", "require"}
+
+// applyProbeFile reads the Kubernetes probe at path and sets the flags
+// matching its timing fields, unless they were already set. The initial delay
+// and the thresholds are ignored when running a single check, as Docker runs
+// the healthcheck again for every check, and the period, which defaults to 10
+// seconds as in Kubernetes, sets -interval when -mode selects a long-running
+// mode. It returns every problem found in the file.
+func applyProbeFile(path string) []error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read probe file: %s", err)}
+	}
+
+	p := &kubernetesProbe{}
+	err = yaml.Unmarshal(contents, p)
+	if err != nil {
+		return []error{fmt.Errorf("failed to parse probe file %s: %s", path, err)}
+	}
+
+	problems := validateProbe(p)
+	if len(problems) > 0 {
+		for i, problem := range problems {
+			problems[i] = fmt.Errorf("invalid probe in %s: %s", path, problem)
+		}
+		return problems
+	}
+	probe = p
+
+	explicit := explicitFlags()
+	for _, name := range probeFlags {
+		if explicit[name] {
+			problems = append(problems, fmt.Errorf("-%s conflicts with -probe-file", name))
+		}
+	}
+
+	selected, _ := selectMode()
+	setSeconds := func(name string, seconds *int) {
+		if seconds != nil && !explicit[name] {
+			// #nosec G104 - durations are always valid values of duration flags
+			flag.Set(name, (time.Duration(*seconds) * time.Second).String())
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil && !explicit[name] {
+			// #nosec G104 - integers are always valid values of int flags
+			flag.Set(name, strconv.Itoa(*value))
+		}
+	}
+	setSeconds("timeout", p.TimeoutSeconds)
+	if selected != onceMode {
+		setSeconds("initial-delay", p.InitialDelaySeconds)
+		setInt("failure-threshold", p.FailureThreshold)
+		setInt("success-threshold", p.SuccessThreshold)
+	}
+	if *modeFlag != "" && selected != onceMode && selected != lifecycleMode {
+		period := defaultPeriodSeconds
+		if p.PeriodSeconds != nil {
+			period = *p.PeriodSeconds
+		}
+		setSeconds("interval", &period)
+	}
+
+	return problems
+}
+
+func validateProbe(p *kubernetesProbe) []error {
+	problems := []error{}
+	handlers := 0
+	for _, set := range []bool{p.HTTPGet != nil, p.TCPSocket != nil, p.GRPC != nil, p.Exec != nil} {
+		if set {
+			handlers++
+		}
+	}
+	if handlers != 1 {
+		problems = append(problems, fmt.Errorf("exactly one of httpGet, tcpSocket, grpc or exec must be set"))
+	}
+
+	validatePort := func(handler, port string) {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, fmt.Errorf("invalid %s port %q: must be a port number, named ports are not supported", handler, port))
+		}
+	}
+	switch {
+	case p.HTTPGet != nil:
+		validatePort("httpGet", p.HTTPGet.Port)
+		if scheme := strings.ToUpper(p.HTTPGet.Scheme); scheme != "" && scheme != "HTTP" && scheme != "HTTPS" {
+			problems = append(problems, fmt.Errorf("invalid httpGet scheme %q: must be HTTP or HTTPS", p.HTTPGet.Scheme))
+		}
+	case p.TCPSocket != nil:
+		validatePort("tcpSocket", p.TCPSocket.Port)
+	case p.GRPC != nil:
+		validatePort("grpc", p.GRPC.Port)
+	case p.Exec != nil:
+		if len(p.Exec.Command) == 0 {
+			problems = append(problems, fmt.Errorf("exec requires a command"))
+		}
+	}
+
+	for _, f := range []struct {
+		name  string
+		value *int
+		min   int
+	}{
+		{"initialDelaySeconds", p.InitialDelaySeconds, 0},
+		{"periodSeconds", p.PeriodSeconds, 1},
+		{"timeoutSeconds", p.TimeoutSeconds, 1},
+		{"failureThreshold", p.FailureThreshold, 1},
+		{"successThreshold", p.SuccessThreshold, 1},
+	} {
+		if f.value != nil && *f.value < f.min {
+			problems = append(problems, fmt.Errorf("invalid %s %d: must be at least %d", f.name, *f.value, f.min))
+		}
+	}
+
+	return problems
+}
+
+// probeChecker returns the check described by the probe.
+func probeChecker(p *kubernetesProbe) healthcheck.Checker {
+	var (
+		h    healthcheck.HealthCheck
+		host string
+	)
+	switch {
+	case p.HTTPGet != nil:
+		path := probePath(p.HTTPGet)
+		checkPort := p.HTTPGet.Port
+		if p.HTTPGet.Host == "" {
+			checkPort = mapPort(checkPort)
+		}
+		if strings.EqualFold(p.HTTPGet.Scheme, "HTTPS") || (p.HTTPGet.Host == "" && viaTLSProxy()) {
+			h = healthcheck.NewHTTPSHealthCheck(*network, path, checkPort, *timeout)
+		} else {
+			h = healthcheck.NewHealthCheck(*network, path, checkPort, *timeout)
+		}
+		headers := http.Header{}
+		for _, header := range p.HTTPGet.HTTPHeaders {
+			headers.Add(header.Name, header.Value)
+		}
+		h.SetHeaders(headers)
+		host = p.HTTPGet.Host
+	case p.TCPSocket != nil:
+		checkPort := p.TCPSocket.Port
+		if p.TCPSocket.Host == "" {
+			checkPort = mapPort(checkPort)
+		}
+		h = healthcheck.NewHealthCheck(*network, "", checkPort, *timeout)
+		host = p.TCPSocket.Host
+	case p.GRPC != nil:
+		h = healthcheck.NewGRPCHealthCheck(*network, p.GRPC.Service, mapPort(p.GRPC.Port), *timeout)
+	case p.Exec != nil:
+		return &execChecker{command: p.Exec.Command, timeout: *timeout}
+	}
+
+	h.SetLogger(debugf)
+	h.SetTracer(probeTracer)
+	if host != "" {
+		return &hostChecker{h: h, host: host}
+	}
+	return withAddress(h)
+}
+
+// probePath returns the path of an httpGet probe, which defaults to /.
+func probePath(action *httpGetAction) string {
+	if !strings.HasPrefix(action.Path, "/") {
+		return "/" + action.Path
+	}
+	return action.Path
+}
+
+// probePorts returns the ports of the app checked by the probe, i.e. unless
+// the probe checks another host.
+func probePorts(p *kubernetesProbe) []string {
+	switch {
+	case p.HTTPGet != nil && p.HTTPGet.Host == "":
+		return []string{p.HTTPGet.Port}
+	case p.TCPSocket != nil && p.TCPSocket.Host == "":
+		return []string{p.TCPSocket.Port}
+	case p.GRPC != nil:
+		return []string{p.GRPC.Port}
+	}
+	return nil
+}
+
+// describeProbe describes the probe in the form of -check values, e.g.
+// https:8443/healthz.
+func describeProbe(p *kubernetesProbe) string {
+	withHost := func(host, port string) string {
+		if host != "" {
+			return net.JoinHostPort(host, port)
+		}
+		return port
+	}
+
+	switch {
+	case p.HTTPGet != nil:
+		path := probePath(p.HTTPGet)
+		scheme := "http"
+		if strings.EqualFold(p.HTTPGet.Scheme, "HTTPS") {
+			scheme = "https"
+		}
+		return scheme + ":" + withHost(p.HTTPGet.Host, p.HTTPGet.Port) + path
+	case p.TCPSocket != nil:
+		return "tcp:" + withHost(p.TCPSocket.Host, p.TCPSocket.Port)
+	case p.GRPC != nil:
+		if p.GRPC.Service != "" {
+			return "grpc:" + p.GRPC.Port + "/" + p.GRPC.Service
+		}
+		return "grpc:" + p.GRPC.Port
+	case p.Exec != nil:
+		return "exec:" + strings.Join(p.Exec.Command, " ")
+	}
+	return ""
+}
+
+// hostChecker runs a check against a host instead of the address of the
+// interfaces.
+type hostChecker struct {
+	h    healthcheck.HealthCheck
+	host string
+}
+
+func (c *hostChecker) CheckInterfaces(interfaces []net.Interface) error {
+	return c.CheckInterfacesContext(context.Background(), interfaces)
+}
+
+func (c *hostChecker) CheckInterfacesContext(ctx context.Context, _ []net.Interface) error {
+	return c.h.CheckHostContext(ctx, c.host)
+}
+
+// execChecker runs a command, and passes if it exits with code 0.
+type execChecker struct {
+	command []string
+	timeout time.Duration
+}
+
+func (c *execChecker) CheckInterfaces(interfaces []net.Interface) error {
+	return c.CheckInterfacesContext(context.Background(), interfaces)
+}
+
+func (c *execChecker) CheckInterfacesContext(ctx context.Context, _ []net.Interface) error {
+	commandCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	// #nosec G204 - running the command given by the probe is the point of exec probes
+	cmd := exec.CommandContext(commandCtx, c.command[0], c.command[1:]...)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	command := strings.Join(c.command, " ")
+	if ctx.Err() == nil && commandCtx.Err() == context.DeadlineExceeded {
+		msg := fmt.Sprintf("command %q timed out after %.2f seconds", command, c.timeout.Seconds())
+		return healthcheck.HealthCheckError{Code: 67, Message: msg}
+	}
+
+	msg := fmt.Sprintf("command %q failed: %s", command, err)
+	if out := strings.TrimSpace(string(output)); out != "" {
+		msg += ": " + out
+	}
+	return healthcheck.HealthCheckError{Code: 9, Message: msg}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusHistorySize is the number of most recent checks served by the status
+// server.
+const statusHistorySize = 20
+
+type modeStatus struct {
+	Status              string    `json:"status"`
+	LastCheck           time.Time `json:"last_check"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+}
+
+type statusAttempt struct {
+	Time time.Time `json:"time"`
+	jsonAttempt
+}
+
+type statusResponse struct {
+	Status  string                `json:"status"`
+	Target  string                `json:"target"`
+	Modes   map[string]modeStatus `json:"modes"`
+	History []statusAttempt       `json:"history"`
+}
+
+// statusObserver serves the latest status of the checks, and the most recent
+// checks, as JSON so that other processes can consume the result of the
+// healthcheck instead of checking the app themselves. When path is set, the
+// status is also written to it after every check.
+type statusObserver struct {
+	target string
+	path   string
+
+	mu       sync.Mutex
+	modes    map[string]modeStatus
+	history  []statusAttempt
+	listener net.Listener
+}
+
+func newStatusObserver(target, path string) *statusObserver {
+	return &statusObserver{target: target, path: path, modes: map[string]modeStatus{}}
+}
+
+// listen listens on a HOST:PORT address, or on a unix socket when the
+// address is of the form unix:PATH. A socket left behind by a previous
+// healthcheck is removed.
+func listen(address string) (net.Listener, error) {
+	path := strings.TrimPrefix(address, "unix:")
+	if path == address {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		// #nosec G104 - a failure to remove the socket is reported by net.Listen
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// serveStatus serves the status on address until the healthcheck finishes.
+func serveStatus(address string, o *statusObserver) error {
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+	o.listener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/status", o)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if o.stopped() {
+			return
+		}
+		logf(warnLevel, "Warning: stopped serving status: %s", err)
+	}()
+	return nil
+}
+
+func (o *statusObserver) stopped() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.listener == nil
+}
+
+func (o *statusObserver) attempted(a attemptEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	status := o.modes[a.mode]
+	status.LastCheck = now
+	if a.err != nil {
+		status.Status = "unhealthy"
+		status.ConsecutiveFailures++
+	} else {
+		status.Status = "healthy"
+		status.ConsecutiveFailures = 0
+	}
+	o.modes[a.mode] = status
+
+	o.history = append(o.history, statusAttempt{Time: now, jsonAttempt: newJSONAttempt(a, o.target)})
+	if len(o.history) > statusHistorySize {
+		o.history = o.history[len(o.history)-statusHistorySize:]
+	}
+
+	if o.path != "" {
+		if err := writeFileAtomically(o.path, o.snapshot()); err != nil {
+			logf(warnLevel, "Warning: failed to write status to %s: %s", o.path, err)
+		}
+	}
+}
+
+// writeFileAtomically writes v as JSON to a temporary file renamed to path,
+// so that readers never see a partially written file.
+func writeFileAtomically(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	// #nosec G104 - the temporary file is only left behind if the rename failed
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		// #nosec G302 - the status is meant to be read by other processes
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (o *statusObserver) transitioned(string, []string) {}
+
+// finished stops serving the status, which removes the unix socket.
+func (o *statusObserver) finished(int, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.listener != nil {
+		// #nosec G104 - the healthcheck is exiting
+		o.listener.Close()
+		o.listener = nil
+	}
+}
+
+// ServeHTTP responds with 200 when the last check of every mode passed, and
+// 503 otherwise or before the first check completed.
+func (o *statusObserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	response := o.snapshot()
+	o.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != "healthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	// #nosec G104 - there is nowhere left to report a failed write to
+	json.NewEncoder(w).Encode(response)
+}
+
+// snapshot returns a copy of the current status, which can be encoded after
+// o.mu is released. o.mu must be held.
+func (o *statusObserver) snapshot() statusResponse {
+	response := statusResponse{
+		Status:  "healthy",
+		Target:  o.target,
+		Modes:   make(map[string]modeStatus, len(o.modes)),
+		History: append([]statusAttempt{}, o.history...),
+	}
+	if len(o.modes) == 0 {
+		response.Status = "unknown"
+	}
+	for mode, status := range o.modes {
+		response.Modes[mode] = status
+		if status.Status != "healthy" {
+			response.Status = "unhealthy"
+		}
+	}
+	return response
+}
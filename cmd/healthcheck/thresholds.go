@@ -0,0 +1,41 @@
+package main
+
+// thresholds tracks consecutive check results, Kubernetes style. Any passing
+// check resets the failure streak, while recovering takes success consecutive
+// passing checks.
+type thresholds struct {
+	failure int
+	success int
+
+	consecutiveFailures  int
+	consecutiveSuccesses int
+}
+
+func newThresholds(failure, success int) thresholds {
+	if success < 1 {
+		success = 1
+	}
+	return thresholds{failure: failure, success: success}
+}
+
+func (t *thresholds) record(err error) {
+	if err != nil {
+		t.consecutiveFailures++
+		t.consecutiveSuccesses = 0
+		return
+	}
+
+	t.consecutiveFailures = 0
+	t.consecutiveSuccesses++
+}
+
+// passed reports whether the last success checks all passed.
+func (t *thresholds) passed() bool {
+	return t.consecutiveSuccesses >= t.success
+}
+
+// failed reports whether the last failure checks all failed. A failure
+// threshold of zero never fails.
+func (t *thresholds) failed() bool {
+	return t.failure > 0 && t.consecutiveFailures >= t.failure
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/healthcheck"
+)
+
+const (
+	// spanQueueSize bounds the spans waiting to be exported, spans ended
+	// while the queue is full are dropped.
+	spanQueueSize = 512
+	// exportTimeout bounds every export, and the flush of the queue before
+	// the healthcheck exits.
+	exportTimeout = 2 * time.Second
+)
+
+// probeTracer is set on every check when -otlp-endpoint is set.
+var probeTracer healthcheck.Tracer
+
+// otlpTracer exports a span for every probe to an OpenTelemetry collector,
+// using OTLP with JSON encoding over HTTP. Spans are exported in the
+// background and flushed when the healthcheck finishes.
+type otlpTracer struct {
+	url    string
+	client *http.Client
+	done   chan struct{}
+
+	// mu guards queue, which is closed once the healthcheck finishes. Spans
+	// of checks still in flight at that point are dropped.
+	mu     sync.Mutex
+	queue  chan *otlpSpan
+	closed bool
+}
+
+func newOTLPTracer(endpoint string) *otlpTracer {
+	t := &otlpTracer{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: exportTimeout},
+		queue:  make(chan *otlpSpan, spanQueueSize),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *otlpTracer) StartSpan(ctx context.Context, name string) healthcheck.Span {
+	return &otlpSpan{
+		tracer:  t,
+		traceID: randomHex(16),
+		spanID:  randomHex(8),
+		name:    name,
+		start:   time.Now(),
+	}
+}
+
+func (t *otlpTracer) run() {
+	defer close(t.done)
+	for span := range t.queue {
+		batch := []*otlpSpan{span}
+	drain:
+		for len(batch) < spanQueueSize {
+			select {
+			case span, ok := <-t.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, span)
+			default:
+				break drain
+			}
+		}
+
+		if err := t.export(batch); err != nil {
+			logf(warnLevel, "Warning: failed to export %d spans to %s: %s", len(batch), t.url, err)
+		}
+	}
+}
+
+func (t *otlpTracer) export(batch []*otlpSpan) error {
+	spans := make([]otlpSpanJSON, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, span.toJSON())
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", "healthcheck")}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "code.cloudfoundry.org/healthcheck"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// #nosec G104 - the response body carries nothing of interest
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *otlpTracer) enqueue(span *otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		logf(warnLevel, "Warning: dropped span of %s, the export queue is full", span.name)
+	}
+}
+
+func (t *otlpTracer) attempted(attemptEvent) {}
+
+func (t *otlpTracer) transitioned(string, []string) {}
+
+// finished flushes the spans waiting to be exported.
+func (t *otlpTracer) finished(int, string) {
+	t.mu.Lock()
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-time.After(exportTimeout):
+		logf(warnLevel, "Warning: timed out exporting spans to %s", t.url)
+	}
+}
+
+type otlpEvent struct {
+	name string
+	at   time.Time
+}
+
+type otlpSpan struct {
+	tracer  *otlpTracer
+	traceID string
+	spanID  string
+	name    string
+	start   time.Time
+
+	// events are added by the HTTP client, possibly from several goroutines
+	mu         sync.Mutex
+	end        time.Time
+	attributes []otlpAttribute
+	events     []otlpEvent
+	err        error
+}
+
+func (s *otlpSpan) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, stringAttribute(key, value))
+}
+
+func (s *otlpSpan) AddEvent(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, otlpEvent{name: name, at: time.Now()})
+}
+
+func (s *otlpSpan) TraceParent() string {
+	return "00-" + s.traceID + "-" + s.spanID + "-01"
+}
+
+func (s *otlpSpan) End(err error) {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+func (s *otlpSpan) toJSON() otlpSpanJSON {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpanJSON{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		Name:              s.name,
+		Kind:              otlpSpanKindClient,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        s.attributes,
+		Status:            otlpStatus{Code: otlpStatusOK},
+	}
+	for _, e := range s.events {
+		span.Events = append(span.Events, otlpEventJSON{Name: e.name, TimeUnixNano: unixNano(e.at)})
+	}
+	if s.err != nil {
+		message, code := describeFailure(s.err)
+		span.Attributes = append(span.Attributes, stringAttribute("healthcheck.error.code", strconv.Itoa(code)))
+		span.Status = otlpStatus{Code: otlpStatusError, Message: message}
+	}
+	return span
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	// #nosec G104 - crypto/rand.Read does not fail on supported platforms
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest, limited to the
+// fields set by the healthcheck.
+
+const (
+	otlpSpanKindClient = 3
+	otlpStatusOK       = 1
+	otlpStatusError    = 2
+)
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope      `json:"scope"`
+	Spans []otlpSpanJSON `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpanJSON struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEventJSON `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpEventJSON struct {
+	Name         string `json:"name"`
+	TimeUnixNano string `json:"timeUnixNano"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
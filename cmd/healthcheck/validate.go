@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Modes selected by -mode or by the interval flags.
+const (
+	onceMode       = "once"
+	startupMode    = "startup"
+	livenessMode   = "liveness"
+	readinessMode  = "readiness"
+	untilReadyMode = "until-ready"
+	lifecycleMode  = "lifecycle"
+)
+
+// validateFlags returns the selected mode along with every problem with the
+// combination of flags, so that they can all be reported at once.
+func validateFlags() (string, []error) {
+	selected, problems := selectMode()
+
+	ports := []string{}
+	for _, spec := range checks {
+		parsed, err := parseCheckSpec(spec)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		ports = append(ports, parsed.port)
+	}
+	switch {
+	case probe != nil:
+		ports = probePorts(probe)
+	case len(checks) == 0:
+		ports = strings.Split(*port, ",")
+	}
+	problems = append(problems, validatePortMapping(ports)...)
+	if probe != nil && probe.GRPC != nil && viaTLSProxy() {
+		problems = append(problems, fmt.Errorf("grpc probes cannot be checked through the TLS proxy selected by -port-mapping=external-tls-proxy"))
+	}
+	problems = append(problems, validateAddress()...)
+	problems = append(problems, validateDependencies()...)
+
+	if len(checks) > 0 || strings.Contains(*port, ",") {
+		count := len(checks)
+		if count == 0 {
+			count = len(strings.Split(*port, ","))
+		}
+		quorum, err := parseQuorum(*require)
+		switch {
+		case err != nil:
+			problems = append(problems, err)
+		case quorum > count:
+			problems = append(problems, fmt.Errorf("invalid value %q for -require: only %d checks to run", *require, count))
+		}
+	}
+
+	if len(checks) == 0 {
+		if _, err := portURIs(strings.Split(*port, ",")); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if *failureThreshold < 0 {
+		problems = append(problems, fmt.Errorf("invalid value %d for -failure-threshold: must not be negative", *failureThreshold))
+	}
+	if *successThreshold < 1 {
+		problems = append(problems, fmt.Errorf("invalid value %d for -success-threshold: must be at least 1", *successThreshold))
+	}
+
+	if *failureWindowSize < 0 {
+		problems = append(problems, fmt.Errorf("invalid value %d for -failure-window-size: must not be negative", *failureWindowSize))
+	}
+	if *failureWindowPercent < 0 || *failureWindowPercent > 100 {
+		problems = append(problems, fmt.Errorf("invalid value %g for -failure-window-percent: must be between 0 and 100", *failureWindowPercent))
+	}
+
+	if *backoffMultiplier < 1 {
+		problems = append(problems, fmt.Errorf("invalid value %g for -backoff-multiplier: must be at least 1", *backoffMultiplier))
+	}
+	if *backoffJitter < 0 || *backoffJitter > 1 {
+		problems = append(problems, fmt.Errorf("invalid value %g for -backoff-jitter: must be between 0 and 1", *backoffJitter))
+	}
+
+	return selected, problems
+}
+
+// selectMode returns the mode selected by -mode, -lifecycle or the interval
+// flags, and every conflicting or meaningless combination of flags.
+func selectMode() (string, []error) {
+	explicit := explicitFlags()
+
+	intervalFlags := []string{}
+	for _, f := range []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"startup-interval", *startupInterval},
+		{"liveness-interval", *livenessInterval},
+		{"readiness-interval", *readinessInterval},
+		{"until-ready-interval", *untilReadyInterval},
+	} {
+		if f.interval > 0 {
+			intervalFlags = append(intervalFlags, "-"+f.name)
+		}
+	}
+
+	problems := []error{}
+	selected := onceMode
+	switch {
+	case *lifecycle || *modeFlag == lifecycleMode:
+		selected = lifecycleMode
+		if *modeFlag != "" && *modeFlag != lifecycleMode {
+			problems = append(problems, fmt.Errorf("-lifecycle conflicts with -mode=%s", *modeFlag))
+		}
+		if *startupInterval <= 0 || *livenessInterval <= 0 {
+			problems = append(problems, fmt.Errorf("-lifecycle requires -startup-interval and -liveness-interval"))
+		}
+		if *untilReadyInterval > 0 {
+			problems = append(problems, fmt.Errorf("-until-ready-interval conflicts with -lifecycle"))
+		}
+		if explicit["interval"] {
+			problems = append(problems, fmt.Errorf("-interval conflicts with -lifecycle, which uses -startup-interval, -liveness-interval and -readiness-interval"))
+		}
+
+	case *modeFlag != "":
+		switch *modeFlag {
+		case onceMode, startupMode, livenessMode, readinessMode, untilReadyMode:
+			selected = *modeFlag
+		default:
+			problems = append(problems, fmt.Errorf("invalid value %q for -mode: must be once, startup, liveness, readiness, until-ready or lifecycle", *modeFlag))
+		}
+		if len(intervalFlags) > 0 {
+			problems = append(problems, fmt.Errorf("-mode conflicts with %s, use -interval instead", strings.Join(intervalFlags, ", ")))
+		}
+		if selected == onceMode && explicit["interval"] {
+			problems = append(problems, fmt.Errorf("-interval is not relevant with -mode=once"))
+		}
+		if selected != onceMode && *interval <= 0 {
+			problems = append(problems, fmt.Errorf("-mode=%s requires -interval", *modeFlag))
+		}
+
+	default:
+		if len(intervalFlags) > 1 {
+			problems = append(problems, fmt.Errorf("conflicting modes: only one of %s may be set", strings.Join(intervalFlags, ", ")))
+		}
+		if explicit["interval"] {
+			problems = append(problems, fmt.Errorf("-interval is only relevant with -mode"))
+		}
+		switch {
+		case *startupInterval > 0:
+			selected = startupMode
+		case *livenessInterval > 0:
+			selected = livenessMode
+		case *readinessInterval > 0:
+			selected = readinessMode
+		case *untilReadyInterval > 0:
+			selected = untilReadyMode
+		}
+	}
+
+	relevantIn := func(name string, modes ...string) {
+		if !explicit[name] {
+			return
+		}
+		for _, m := range modes {
+			if m == selected {
+				return
+			}
+		}
+		problems = append(problems, fmt.Errorf("-%s is not relevant in %s mode, only in %s modes", name, selected, strings.Join(modes, ", ")))
+	}
+	relevantIn("startup-timeout", startupMode, lifecycleMode)
+	for _, name := range []string{"backoff-multiplier", "backoff-max-interval", "backoff-jitter"} {
+		relevantIn(name, startupMode, untilReadyMode, lifecycleMode)
+	}
+	for _, name := range []string{"failure-window-size", "failure-window-duration", "failure-window-percent"} {
+		relevantIn(name, livenessMode, readinessMode, lifecycleMode)
+	}
+	for _, name := range []string{"failure-threshold", "success-threshold"} {
+		relevantIn(name, startupMode, livenessMode, readinessMode, untilReadyMode, lifecycleMode)
+	}
+
+	if _, err := parseLogLevel(*logLevelFlag); err != nil {
+		problems = append(problems, err)
+	}
+
+	if *exitCodes != "detailed" && *exitCodes != "docker" {
+		problems = append(problems, fmt.Errorf("invalid value %q for -exit-codes: must be detailed or docker", *exitCodes))
+	}
+
+	if *output != "text" && *output != "json" {
+		problems = append(problems, fmt.Errorf("invalid value %q for -output: must be text or json", *output))
+	}
+
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"otlp-endpoint", *otlpEndpoint},
+		{"webhook-url", *webhookURL},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if err := validateHTTPURL(f.name, f.value); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if *webhookRetries < 0 {
+		problems = append(problems, fmt.Errorf("invalid value %d for -webhook-retries: must not be negative", *webhookRetries))
+	}
+
+	for _, name := range []string{"metrics-listen", "status-listen", "status-file", "webhook-url", "webhook-retries"} {
+		relevantIn(name, startupMode, livenessMode, readinessMode, untilReadyMode, lifecycleMode)
+	}
+	for _, name := range []string{"dependency", "optional-dependency", "dependency-timeout"} {
+		relevantIn(name, readinessMode, untilReadyMode, lifecycleMode)
+		if explicit[name] && selected == lifecycleMode && *readinessInterval <= 0 {
+			problems = append(problems, fmt.Errorf("-%s is only relevant in lifecycle mode if readiness-interval is set", name))
+		}
+	}
+
+	if explicit["tls-cert-expiry-window"] && !*tlsCert && !hasTLSCheck() {
+		problems = append(problems, fmt.Errorf("-tls-cert-expiry-window is only relevant with -tls-cert or tls checks"))
+	}
+	if explicit["require"] && len(checks) == 0 && !strings.Contains(*port, ",") {
+		problems = append(problems, fmt.Errorf("-require is only relevant with -check or a list of ports"))
+	}
+
+	return selected, problems
+}
+
+func validateHTTPURL(name, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid value %q for -%s: must be an http or https URL", value, name)
+	}
+	return nil
+}
+
+func hasTLSCheck() bool {
+	for _, spec := range checks {
+		if strings.HasPrefix(spec, "tls:") {
+			return true
+		}
+	}
+	return false
+}
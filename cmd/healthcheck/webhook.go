@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookQueueSize bounds the events waiting to be delivered, events
+	// of transitions while the queue is full are dropped.
+	webhookQueueSize = 100
+	// webhookTimeout bounds every delivery attempt.
+	webhookTimeout = 5 * time.Second
+	// webhookRetryInterval is the delay before the first retry of a failed
+	// delivery, doubling for every further retry.
+	webhookRetryInterval = 500 * time.Millisecond
+	// webhookFlushTimeout bounds the delivery of the events still queued
+	// when the healthcheck finishes.
+	webhookFlushTimeout = 10 * time.Second
+)
+
+type webhookEvent struct {
+	Event   string      `json:"event"`
+	Time    time.Time   `json:"time"`
+	Mode    string      `json:"mode"`
+	Target  string      `json:"target"`
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	Attempt jsonAttempt `json:"attempt"`
+}
+
+// webhookObserver posts an event to a URL whenever the result of the checks
+// of a mode changes from healthy to unhealthy or back, and when the first
+// check of a mode fails. Events are delivered
+// in the background, so that a slow receiver does not delay the checks.
+type webhookObserver struct {
+	url     string
+	target  string
+	retries int
+	client  *http.Client
+	done    chan struct{}
+
+	// mu guards the state of every mode and queue, which is closed once the
+	// healthcheck finishes.
+	mu     sync.Mutex
+	states map[string]string
+	queue  chan webhookEvent
+	closed bool
+}
+
+func newWebhookObserver(url, target string, retries int) *webhookObserver {
+	o := &webhookObserver{
+		url:     url,
+		target:  target,
+		retries: retries,
+		client:  &http.Client{Timeout: webhookTimeout},
+		done:    make(chan struct{}),
+		states:  map[string]string{},
+		queue:   make(chan webhookEvent, webhookQueueSize),
+	}
+	go o.run()
+	return o
+}
+
+func (o *webhookObserver) run() {
+	defer close(o.done)
+	for event := range o.queue {
+		o.deliver(event)
+	}
+}
+
+func (o *webhookObserver) deliver(event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logf(warnLevel, "Warning: failed to encode webhook event: %s", err)
+		return
+	}
+
+	b := newBackoff(webhookRetryInterval, 2, 0, 0)
+	for attempt := 0; ; attempt++ {
+		err = o.post(body)
+		if err == nil {
+			return
+		}
+		if attempt == o.retries {
+			logf(warnLevel, "Warning: failed to deliver %s %s event to %s after %d attempts: %s", event.Mode, event.To, o.url, attempt+1, err)
+			return
+		}
+		logf(infoLevel, "failed to deliver %s %s event to %s, retrying: %s", event.Mode, event.To, o.url, err)
+		time.Sleep(b.next())
+	}
+}
+
+func (o *webhookObserver) post(body []byte) error {
+	resp, err := o.client.Post(o.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// #nosec G104 - the response body carries nothing of interest
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("received status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (o *webhookObserver) attempted(a attemptEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	state := "healthy"
+	if a.err != nil {
+		state = "unhealthy"
+	}
+	// The state of a mode is unknown until its first check. Only a first
+	// check failing is worth an event, e.g. in the liveness mode it also is
+	// the last one.
+	previous, ok := o.states[a.mode]
+	if !ok {
+		previous = "unknown"
+	}
+	o.states[a.mode] = state
+	if previous == state || (!ok && state == "healthy") || o.closed {
+		return
+	}
+
+	event := webhookEvent{
+		Event:   "health_changed",
+		Time:    time.Now(),
+		Mode:    a.mode,
+		Target:  o.target,
+		From:    previous,
+		To:      state,
+		Attempt: newJSONAttempt(a, o.target),
+	}
+	select {
+	case o.queue <- event:
+	default:
+		logf(warnLevel, "Warning: dropped %s %s event, the webhook queue is full", a.mode, state)
+	}
+}
+
+func (o *webhookObserver) transitioned(string, []string) {}
+
+// finished waits for the queued events to be delivered.
+func (o *webhookObserver) finished(int, string) {
+	o.mu.Lock()
+	o.closed = true
+	close(o.queue)
+	o.mu.Unlock()
+
+	select {
+	case <-o.done:
+	case <-time.After(webhookFlushTimeout):
+		logf(warnLevel, "Warning: timed out delivering events to %s", o.url)
+	}
+}
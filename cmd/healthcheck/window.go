@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type windowResult struct {
+	at     time.Time
+	failed bool
+}
+
+// slidingWindow tracks the results of the checks in the last size attempts
+// and/or the last duration, and fails once more than percent of them failed.
+// This catches flapping apps that never fail enough consecutive checks to hit
+// the failure threshold.
+type slidingWindow struct {
+	size     int
+	duration time.Duration
+	percent  float64
+
+	started time.Time
+	results []windowResult
+}
+
+func newSlidingWindow(size int, duration time.Duration, percent float64) *slidingWindow {
+	return &slidingWindow{size: size, duration: duration, percent: percent}
+}
+
+func (w *slidingWindow) enabled() bool {
+	return w.percent > 0 && (w.size > 0 || w.duration > 0)
+}
+
+func (w *slidingWindow) record(at time.Time, err error) {
+	if w.started.IsZero() {
+		w.started = at
+	}
+
+	w.results = append(w.results, windowResult{at: at, failed: err != nil})
+	if w.size > 0 && len(w.results) > w.size {
+		w.results = w.results[len(w.results)-w.size:]
+	}
+	if w.duration > 0 {
+		cutoff := at.Add(-w.duration)
+		i := 0
+		for i < len(w.results) && w.results[i].at.Before(cutoff) {
+			i++
+		}
+		w.results = w.results[i:]
+	}
+}
+
+// full reports whether enough checks have run to cover the whole window, so a
+// single early failure cannot fail the healthcheck.
+func (w *slidingWindow) full(now time.Time) bool {
+	if w.size > 0 && len(w.results) < w.size {
+		return false
+	}
+	if w.duration > 0 && now.Sub(w.started) < w.duration {
+		return false
+	}
+	return true
+}
+
+func (w *slidingWindow) failures() int {
+	failures := 0
+	for _, r := range w.results {
+		if r.failed {
+			failures++
+		}
+	}
+	return failures
+}
+
+func (w *slidingWindow) failurePercent() float64 {
+	if len(w.results) == 0 {
+		return 0
+	}
+	return 100 * float64(w.failures()) / float64(len(w.results))
+}
+
+func (w *slidingWindow) failed(now time.Time) bool {
+	return w.enabled() && w.full(now) && w.failurePercent() > w.percent
+}
+
+func (w *slidingWindow) String() string {
+	var window string
+	switch {
+	case w.size > 0 && w.duration > 0:
+		window = fmt.Sprintf("the last %d attempts within %s", w.size, w.duration)
+	case w.size > 0:
+		window = fmt.Sprintf("the last %d attempts", w.size)
+	default:
+		window = fmt.Sprintf("the last %s", w.duration)
+	}
+
+	return fmt.Sprintf(
+		"%d of %d checks failed in %s (%.1f%%, more than %.1f%% allowed)",
+		w.failures(),
+		len(w.results),
+		window,
+		w.failurePercent(),
+		w.percent,
+	)
+}
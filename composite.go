@@ -0,0 +1,94 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// QuorumAll requires every component of a CompositeHealthCheck to pass.
+	QuorumAll = 0
+	// QuorumAny requires at least one component of a CompositeHealthCheck to pass.
+	QuorumAny = 1
+)
+
+type Checker interface {
+	CheckInterfaces(interfaces []net.Interface) error
+	CheckInterfacesContext(ctx context.Context, interfaces []net.Interface) error
+}
+
+type Component struct {
+	Name    string
+	Checker Checker
+}
+
+type CompositeHealthCheck struct {
+	quorum     int
+	components []Component
+}
+
+// NewCompositeHealthCheck returns a check that runs every component in
+// parallel and passes when at least quorum of them pass. A quorum of
+// QuorumAll requires all of them to pass, and one larger than the number of
+// components never passes.
+func NewCompositeHealthCheck(quorum int, components ...Component) CompositeHealthCheck {
+	if quorum <= QuorumAll {
+		quorum = len(components)
+	}
+	return CompositeHealthCheck{quorum: quorum, components: components}
+}
+
+func (c *CompositeHealthCheck) CheckInterfaces(interfaces []net.Interface) error {
+	return c.CheckInterfacesContext(context.Background(), interfaces)
+}
+
+// CheckInterfacesContext is like CheckInterfaces, but cancels the checks in
+// flight when ctx is done.
+func (c *CompositeHealthCheck) CheckInterfacesContext(ctx context.Context, interfaces []net.Interface) error {
+	errs := make([]error, len(c.components))
+
+	wg := sync.WaitGroup{}
+	for i, component := range c.components {
+		wg.Add(1)
+		go func(i int, checker Checker) {
+			defer wg.Done()
+			errs[i] = checker.CheckInterfacesContext(ctx, interfaces)
+		}(i, component.Checker)
+	}
+	wg.Wait()
+
+	code, statusCode := 0, 0
+	var timings *HTTPTimings
+	failures := []string{}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		if hErr, ok := err.(HealthCheckError); ok {
+			if code == 0 {
+				code = hErr.Code
+				statusCode = hErr.StatusCode
+				timings = hErr.Timings
+			}
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", c.components[i].Name, err.Error()))
+	}
+
+	passed := len(c.components) - len(failures)
+	if passed >= c.quorum {
+		return nil
+	}
+
+	if code == 0 {
+		code = 127
+	}
+	msg := fmt.Sprintf("%d of %d checks passed, %d required", passed, len(c.components), c.quorum)
+	if len(failures) > 0 {
+		msg += ": " + strings.Join(failures, "; ")
+	}
+	return HealthCheckError{Code: code, Message: msg, StatusCode: statusCode, Timings: timings}
+}
@@ -0,0 +1,148 @@
+package healthcheck_test
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"code.cloudfoundry.org/healthcheck"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakeChecker struct {
+	err error
+}
+
+func (f *fakeChecker) CheckInterfaces([]net.Interface) error {
+	return f.err
+}
+
+func (f *fakeChecker) CheckInterfacesContext(context.Context, []net.Interface) error {
+	return f.err
+}
+
+var _ = Describe("CompositeHealthCheck", func() {
+	var (
+		quorum     int
+		components []healthcheck.Component
+		composite  healthcheck.CompositeHealthCheck
+	)
+
+	passing := func(name string) healthcheck.Component {
+		return healthcheck.Component{Name: name, Checker: &fakeChecker{}}
+	}
+
+	failing := func(name string, code int, message string) healthcheck.Component {
+		return healthcheck.Component{
+			Name:    name,
+			Checker: &fakeChecker{err: healthcheck.HealthCheckError{Code: code, Message: message}},
+		}
+	}
+
+	BeforeEach(func() {
+		quorum = healthcheck.QuorumAll
+		components = []healthcheck.Component{
+			passing("http:8080/health"),
+			failing("tcp:9090", 4, "failed to make TCP connection"),
+			failing("tcp:9091", 64, "timed out after 1.00 seconds"),
+		}
+	})
+
+	JustBeforeEach(func() {
+		composite = healthcheck.NewCompositeHealthCheck(quorum, components...)
+	})
+
+	Context("when all components are required", func() {
+		It("fails with the code of the first failing component", func() {
+			err := composite.CheckInterfaces(nil)
+			Expect(err).To(BeAssignableToTypeOf(healthcheck.HealthCheckError{}))
+			Expect(err.(healthcheck.HealthCheckError).Code).To(Equal(4))
+		})
+
+		It("lists each failing component", func() {
+			err := composite.CheckInterfaces(nil)
+			Expect(err).To(MatchError(
+				"1 of 3 checks passed, 3 required: tcp:9090: failed to make TCP connection; tcp:9091: timed out after 1.00 seconds",
+			))
+		})
+
+		Context("when every component passes", func() {
+			BeforeEach(func() {
+				components = []healthcheck.Component{passing("tcp:8080"), passing("tcp:9090")}
+			})
+
+			It("succeeds", func() {
+				Expect(composite.CheckInterfaces(nil)).To(Succeed())
+			})
+		})
+	})
+
+	Context("when any component is required", func() {
+		BeforeEach(func() {
+			quorum = healthcheck.QuorumAny
+		})
+
+		It("succeeds when one component passes", func() {
+			Expect(composite.CheckInterfaces(nil)).To(Succeed())
+		})
+
+		Context("when no component passes", func() {
+			BeforeEach(func() {
+				components = components[1:]
+			})
+
+			It("fails", func() {
+				Expect(composite.CheckInterfaces(nil)).To(MatchError(ContainSubstring("0 of 2 checks passed, 1 required")))
+			})
+		})
+	})
+
+	Context("when a quorum is required", func() {
+		BeforeEach(func() {
+			quorum = 2
+		})
+
+		It("fails when fewer components pass", func() {
+			Expect(composite.CheckInterfaces(nil)).To(MatchError(ContainSubstring("1 of 3 checks passed, 2 required")))
+		})
+
+		Context("when the quorum is met", func() {
+			BeforeEach(func() {
+				components = append(components, passing("tcp:9092"))
+			})
+
+			It("succeeds", func() {
+				Expect(composite.CheckInterfaces(nil)).To(Succeed())
+			})
+		})
+
+		Context("when the quorum is larger than the number of components", func() {
+			BeforeEach(func() {
+				components = []healthcheck.Component{passing("tcp:8080")}
+			})
+
+			It("fails even though every component passes", func() {
+				err := composite.CheckInterfaces(nil)
+				Expect(err).To(MatchError("1 of 1 checks passed, 2 required"))
+				Expect(err.(healthcheck.HealthCheckError).Code).To(Equal(127))
+			})
+		})
+	})
+
+	Context("when a component fails with an unknown error", func() {
+		BeforeEach(func() {
+			components = []healthcheck.Component{
+				{Name: "custom", Checker: &fakeChecker{err: errors.New("boom")}},
+			}
+		})
+
+		It("fails with code 127", func() {
+			err := composite.CheckInterfaces(nil)
+			Expect(err).To(BeAssignableToTypeOf(healthcheck.HealthCheckError{}))
+			Expect(err.(healthcheck.HealthCheckError).Code).To(Equal(127))
+			Expect(err).To(MatchError(ContainSubstring("custom: boom")))
+		})
+	})
+})
@@ -0,0 +1,212 @@
+package healthcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// grpcHealthCheckPath is the path of the Check method of the
+// grpc.health.v1.Health service, called by Kubernetes gRPC probes.
+const grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+// grpcServing is the SERVING status of a grpc.health.v1.HealthCheckResponse.
+const grpcServing = 1
+
+var grpcServingStatuses = map[uint64]string{
+	0: "UNKNOWN",
+	1: "SERVING",
+	2: "NOT_SERVING",
+	3: "SERVICE_UNKNOWN",
+}
+
+// NewGRPCHealthCheck returns a HealthCheck that calls the gRPC health service
+// on the port, over HTTP/2 without TLS as Kubernetes gRPC probes do, and fails
+// unless it reports service as serving. An empty service stands for the
+// server as a whole.
+func NewGRPCHealthCheck(network, service, port string, timeout time.Duration) HealthCheck {
+	return HealthCheck{
+		network:     network,
+		port:        port,
+		timeout:     timeout,
+		grpc:        true,
+		grpcService: service,
+	}
+}
+
+func (h *HealthCheck) GRPCHealthCheck(ip string) error {
+	return h.GRPCHealthCheckContext(context.Background(), ip)
+}
+
+func (h *HealthCheck) GRPCHealthCheckContext(ctx context.Context, ip string) error {
+	span := h.startSpan(ctx, "grpc healthcheck")
+	err := h.grpcHealthCheck(ctx, ip, span)
+	span.End(err)
+	return err
+}
+
+func (h *HealthCheck) grpcHealthCheck(ctx context.Context, ip string, span Span) error {
+	addr := net.JoinHostPort(ip, h.port)
+	span.SetAttribute("server.address", ip)
+	span.SetAttribute("server.port", h.port)
+	span.SetAttribute("rpc.service", "grpc.health.v1.Health")
+
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	dialer := &net.Dialer{Timeout: h.timeout}
+	client := http.Client{
+		Timeout: h.timeout,
+		Transport: &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, h.network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+addr+grpcHealthCheckPath, bytes.NewReader(grpcHealthCheckRequest(h.grpcService)))
+	if err != nil {
+		return HealthCheckError{Code: 10, Message: fmt.Sprintf("failed to create a gRPC health check request to port %s", h.port)}
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "diego-healthcheck")
+	if traceParent := span.TraceParent(); traceParent != "" {
+		req.Header.Set("traceparent", traceParent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return h.grpcCallError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return h.grpcCallError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return h.grpcCallError(fmt.Errorf("received HTTP status code %d", resp.StatusCode))
+	}
+
+	// Servers failing the call right away send the status along with the
+	// headers rather than as trailers.
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	span.SetAttribute("rpc.grpc.status_code", status)
+	if status != "0" {
+		return h.grpcCallError(fmt.Errorf("received gRPC status %s: %s", status, message))
+	}
+
+	servingStatus, err := parseGRPCHealthCheckResponse(body)
+	if err != nil {
+		return h.grpcCallError(fmt.Errorf("invalid response: %s", err))
+	}
+	if servingStatus == grpcServing {
+		return nil
+	}
+
+	name, ok := grpcServingStatuses[servingStatus]
+	if !ok {
+		name = fmt.Sprintf("status %d", servingStatus)
+	}
+	service := "the server"
+	if h.grpcService != "" {
+		service = fmt.Sprintf("service %q", h.grpcService)
+	}
+	return HealthCheckError{Code: 11, Message: fmt.Sprintf("gRPC health service on port %s reports %s as %s", h.port, service, name)}
+}
+
+func (h *HealthCheck) grpcCallError(err error) error {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		msg := fmt.Sprintf("failed to call the gRPC health service on port %s: timed out after %.2f seconds", h.port, h.timeout.Seconds())
+		return HealthCheckError{Code: 68, Message: msg}
+	}
+	return HealthCheckError{Code: 10, Message: fmt.Sprintf("failed to call the gRPC health service on port %s: %s", h.port, err)}
+}
+
+// grpcHealthCheckRequest encodes a grpc.health.v1.HealthCheckRequest, whose
+// only field is the service, as a gRPC message. The messages of the health
+// service are simple enough to be encoded by hand.
+func grpcHealthCheckRequest(service string) []byte {
+	message := []byte{}
+	if service != "" {
+		// field 1, length-delimited
+		message = append(message, 0x0a)
+		message = binary.AppendUvarint(message, uint64(len(service)))
+		message = append(message, service...)
+	}
+
+	// uncompressed flag and length prefix
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// parseGRPCHealthCheckResponse returns the status of the
+// grpc.health.v1.HealthCheckResponse gRPC message in body.
+func parseGRPCHealthCheckResponse(body []byte) (uint64, error) {
+	if len(body) < 5 {
+		return 0, errors.New("missing message")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	message := body[5:]
+	if uint64(len(message)) < uint64(length) {
+		return 0, errors.New("truncated message")
+	}
+	message = message[:length]
+
+	// The status is 0, UNKNOWN, unless set.
+	var status uint64
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("malformed message")
+		}
+		message = message[n:]
+
+		var skip uint64
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("malformed message")
+			}
+			if key>>3 == 1 {
+				status = value
+			}
+			skip = uint64(n)
+		case 1:
+			skip = 8
+		case 2:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || size > uint64(len(message)) {
+				return 0, errors.New("malformed message")
+			}
+			skip = uint64(n) + size
+		case 5:
+			skip = 4
+		default:
+			return 0, errors.New("malformed message")
+		}
+		if uint64(len(message)) < skip {
+			return 0, errors.New("truncated message")
+		}
+		message = message[skip:]
+	}
+	return status, nil
+}
@@ -1,17 +1,26 @@
 package healthcheck
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"strconv"
 	"time"
 )
 
 type HealthCheckError struct {
 	Code    int
 	Message string
+	// StatusCode is the status code of the response when an HTTP check
+	// received one.
+	StatusCode int
+	// Timings is the breakdown of the duration of a failed HTTP check.
+	Timings *HTTPTimings
 }
 
 func (e HealthCheckError) Error() string {
@@ -23,16 +32,120 @@ type HealthCheck struct {
 	uri     string
 	port    string
 	timeout time.Duration
+
+	tls              bool
+	certExpiryWindow time.Duration
+
+	https   bool
+	headers http.Header
+
+	grpc        bool
+	grpcService string
+
+	logf   func(format string, args ...interface{})
+	tracer Tracer
 }
 
 func NewHealthCheck(network, uri, port string, timeout time.Duration) HealthCheck {
-	return HealthCheck{network, uri, port, timeout}
+	return HealthCheck{
+		network: network,
+		uri:     uri,
+		port:    port,
+		timeout: timeout,
+	}
+}
+
+// NewTLSHealthCheck returns a HealthCheck that completes a TLS handshake
+// against the port and fails if the leaf certificate is expired, not yet
+// valid, or expires within expiryWindow.
+func NewTLSHealthCheck(network, port string, timeout, expiryWindow time.Duration) HealthCheck {
+	return HealthCheck{
+		network:          network,
+		port:             port,
+		timeout:          timeout,
+		tls:              true,
+		certExpiryWindow: expiryWindow,
+	}
+}
+
+// NewHTTPSHealthCheck returns a HealthCheck that makes an HTTPS request to
+// the uri. As with NewTLSHealthCheck the certificate is not verified.
+func NewHTTPSHealthCheck(network, uri, port string, timeout time.Duration) HealthCheck {
+	return HealthCheck{
+		network: network,
+		uri:     uri,
+		port:    port,
+		timeout: timeout,
+		https:   true,
+	}
+}
+
+// SetHeaders sets headers sent along with HTTP checks, replacing the headers
+// of the same name sent by default. A Host header sets the host of the
+// request.
+func (h *HealthCheck) SetHeaders(headers http.Header) {
+	h.headers = headers
+}
+
+// SetLogger sets a function called with debug messages describing the
+// decisions made by the check, e.g. which interface address is checked.
+func (h *HealthCheck) SetLogger(logf func(format string, args ...interface{})) {
+	h.logf = logf
 }
 
 func (h *HealthCheck) CheckInterfaces(interfaces []net.Interface) error {
-	healthcheck := h.HTTPHealthCheck
-	if len(h.uri) == 0 {
-		healthcheck = h.PortHealthCheck
+	return h.CheckInterfacesContext(context.Background(), interfaces)
+}
+
+// CheckInterfacesContext is like CheckInterfaces, but cancels the check
+// in flight when ctx is done.
+func (h *HealthCheck) CheckInterfacesContext(ctx context.Context, interfaces []net.Interface) error {
+	ip, ok := ctx.Value(interfaceAddressKey{}).(string)
+	if ok {
+		ok = ip != ""
+	} else {
+		ip, ok = interfaceAddress(interfaces, h.logf)
+	}
+	if !ok {
+		return HealthCheckError{Code: 3, Message: "failure to find suitable interface"}
+	}
+
+	return h.CheckHostContext(ctx, ip)
+}
+
+// CheckHostContext runs the check against host, an IP address or a DNS name,
+// instead of the address of the interfaces.
+func (h *HealthCheck) CheckHostContext(ctx context.Context, host string) error {
+	switch {
+	case h.tls:
+		return h.TLSHealthCheckContext(ctx, host)
+	case h.grpc:
+		return h.GRPCHealthCheckContext(ctx, host)
+	case len(h.uri) == 0:
+		return h.PortHealthCheckContext(ctx, host)
+	}
+	return h.HTTPHealthCheckContext(ctx, host)
+}
+
+// InterfaceAddress returns the address checked by CheckInterfaces, i.e. the
+// first non-loopback IPv4 address of the interfaces.
+func InterfaceAddress(interfaces []net.Interface) (string, bool) {
+	return interfaceAddress(interfaces, nil)
+}
+
+type interfaceAddressKey struct{}
+
+// WithInterfaceAddress returns a copy of ctx with which CheckInterfacesContext
+// checks address instead of looking up the address of the interfaces again,
+// for callers that already looked it up with InterfaceAddress. An empty
+// address means that the interfaces have no suitable address.
+func WithInterfaceAddress(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, interfaceAddressKey{}, address)
+}
+
+func interfaceAddress(interfaces []net.Interface, logf func(format string, args ...interface{})) (string, bool) {
+	if logf == nil {
+		logf = func(string, ...interface{}) {}
 	}
 
 	for _, intf := range interfaces {
@@ -43,19 +156,45 @@ func (h *HealthCheck) CheckInterfaces(interfaces []net.Interface) error {
 		}
 
 		for _, a := range addrs {
-			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
-				err := healthcheck(ipnet.IP.String())
-				return err
+			ipnet, ok := a.(*net.IPNet)
+			switch {
+			case !ok:
+				logf("skipping address %s of interface %s: not an IP network", a, intf.Name)
+			case ipnet.IP.IsLoopback():
+				logf("skipping address %s of interface %s: loopback address", ipnet.IP, intf.Name)
+			case ipnet.IP.To4() == nil:
+				logf("skipping address %s of interface %s: not an IPv4 address", ipnet.IP, intf.Name)
+			default:
+				logf("selected address %s of interface %s", ipnet.IP, intf.Name)
+				return ipnet.IP.String(), true
 			}
 		}
 	}
 
-	return HealthCheckError{Code: 3, Message: "failure to find suitable interface"}
+	logf("no suitable address found in %d interfaces", len(interfaces))
+	return "", false
 }
 
 func (h *HealthCheck) PortHealthCheck(ip string) error {
+	return h.PortHealthCheckContext(context.Background(), ip)
+}
+
+func (h *HealthCheck) PortHealthCheckContext(ctx context.Context, ip string) error {
+	span := h.startSpan(ctx, "tcp healthcheck")
+	err := h.portHealthCheck(ctx, ip, span)
+	span.End(err)
+	return err
+}
+
+func (h *HealthCheck) portHealthCheck(ctx context.Context, ip string, span Span) error {
 	addr := ip + ":" + h.port
-	conn, err := net.DialTimeout(h.network, addr, h.timeout)
+	span.SetAttribute("server.address", ip)
+	span.SetAttribute("server.port", h.port)
+
+	dialer := &net.Dialer{Timeout: h.timeout}
+	span.AddEvent("connect_start")
+	conn, err := dialer.DialContext(ctx, h.network, addr)
+	span.AddEvent("connect_done")
 	if err == nil {
 		// #nosec G104-  don't check this error because we want to return OK if we were able to connect, closing is not an issue
 		conn.Close()
@@ -71,12 +210,42 @@ func (h *HealthCheck) PortHealthCheck(ip string) error {
 }
 
 func (h *HealthCheck) HTTPHealthCheck(ip string) error {
-	addr := fmt.Sprintf("http://%s:%s%s", ip, h.port, h.uri)
+	return h.HTTPHealthCheckContext(context.Background(), ip)
+}
+
+func (h *HealthCheck) HTTPHealthCheckContext(ctx context.Context, ip string) error {
+	span := h.startSpan(ctx, "http healthcheck")
+	err := h.httpHealthCheck(ctx, ip, span)
+	span.End(err)
+	return err
+}
+
+func (h *HealthCheck) httpHealthCheck(ctx context.Context, ip string, span Span) error {
+	scheme := "http"
+	if h.https {
+		scheme = "https"
+	}
+	addr := fmt.Sprintf("%s://%s:%s%s", scheme, ip, h.port, h.uri)
+	span.SetAttribute("server.address", ip)
+	span.SetAttribute("server.port", h.port)
+	span.SetAttribute("url.full", addr)
+
 	client := http.Client{
 		Timeout: h.timeout,
 	}
+	if h.https {
+		client.Transport = &http.Transport{
+			// #nosec G402 - as with the TLS check, app certificates are commonly self-signed
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		}
+	}
+	timer := &httpTimer{}
+	defer func() {
+		reportTimings(ctx, timer.timings())
+	}()
 	now := time.Now()
-	req, err := http.NewRequest("GET", addr, nil)
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, timer.clientTrace(span)), "GET", addr, nil)
 	if err != nil {
 		errMsg := fmt.Sprintf(
 			"failed to create an HTTP request to '%s' on port %s",
@@ -88,6 +257,16 @@ func (h *HealthCheck) HTTPHealthCheck(ip string) error {
 
 	req.Header.Set("User-Agent", "diego-healthcheck")
 	req.Header.Set("X-Forwarded-Proto", "https")
+	for name, values := range h.headers {
+		if http.CanonicalHeaderKey(name) == "Host" && len(values) > 0 {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if traceParent := span.TraceParent(); traceParent != "" {
+		req.Header.Set("traceparent", traceParent)
+	}
 	resp, err := client.Do(req)
 	dur := time.Since(now)
 	if err == nil {
@@ -96,8 +275,11 @@ func (h *HealthCheck) HTTPHealthCheck(ip string) error {
 		// We need to read the request body to prevent extraneous errors in the server.
 		// We could make a HEAD request but there are concerns about servers that may
 		// not implement the RFC correctly.
+		timer.mark(&timer.bodyStart)
 		// #nosec G104 - as such, ignore errors because we don't care about the body as long as its not there anymore
 		io.ReadAll(resp.Body)
+		timer.mark(&timer.bodyDone)
+		span.SetAttribute("http.response.status_code", strconv.Itoa(resp.StatusCode))
 
 		if resp.StatusCode == http.StatusOK {
 			return nil
@@ -110,17 +292,20 @@ func (h *HealthCheck) HTTPHealthCheck(ip string) error {
 			resp.StatusCode,
 			dur.Nanoseconds()/time.Millisecond.Nanoseconds(),
 		)
-		return HealthCheckError{Code: 6, Message: errMsg}
+		timings := timer.timings()
+		return HealthCheckError{Code: 6, Message: errMsg, StatusCode: resp.StatusCode, Timings: &timings}
 	}
 
 	if err, ok := err.(net.Error); ok && err.Timeout() {
 		errMsg := fmt.Sprintf(
-			"failed to make HTTP request to '%s' on port %s: timed out after %.2f seconds",
+			"failed to make HTTP request to '%s' on port %s: timed out after %.2f seconds %s",
 			h.uri,
 			h.port,
 			h.timeout.Seconds(),
+			timer.describeTimeout(),
 		)
-		return HealthCheckError{Code: 65, Message: errMsg}
+		timings := timer.timings()
+		return HealthCheckError{Code: 65, Message: errMsg, Timings: &timings}
 	}
 
 	errMsg := fmt.Sprintf(
@@ -128,5 +313,70 @@ func (h *HealthCheck) HTTPHealthCheck(ip string) error {
 		h.uri,
 		h.port,
 	)
-	return HealthCheckError{Code: 5, Message: errMsg}
+	timings := timer.timings()
+	return HealthCheckError{Code: 5, Message: errMsg, Timings: &timings}
+}
+
+func (h *HealthCheck) TLSHealthCheck(ip string) error {
+	return h.TLSHealthCheckContext(context.Background(), ip)
+}
+
+func (h *HealthCheck) TLSHealthCheckContext(ctx context.Context, ip string) error {
+	span := h.startSpan(ctx, "tls healthcheck")
+	err := h.tlsHealthCheck(ctx, ip, span)
+	span.End(err)
+	return err
+}
+
+func (h *HealthCheck) tlsHealthCheck(ctx context.Context, ip string, span Span) error {
+	addr := ip + ":" + h.port
+	span.SetAttribute("server.address", ip)
+	span.SetAttribute("server.port", h.port)
+
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: h.timeout},
+		// #nosec G402 - the certificate chain is not verified on purpose, app certificates are commonly
+		// self-signed or issued by the instance identity CA. Only the validity period is checked below.
+		Config: &tls.Config{InsecureSkipVerify: true},
+	}
+	span.AddEvent("tls_handshake_start")
+	netConn, err := dialer.DialContext(ctx, h.network, addr)
+	span.AddEvent("tls_handshake_done")
+	if err != nil {
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			msg := fmt.Sprintf("failed to complete TLS handshake with %s: timed out after %.2f seconds", addr, h.timeout.Seconds())
+			return HealthCheckError{Code: 66, Message: msg}
+		}
+
+		return HealthCheckError{Code: 7, Message: fmt.Sprintf("failed to complete TLS handshake with %s: %s", addr, err.Error())}
+	}
+	conn := netConn.(*tls.Conn)
+	// #nosec G104 - the handshake already completed, closing is not an issue
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return HealthCheckError{Code: 7, Message: fmt.Sprintf("failed to complete TLS handshake with %s: no certificate presented", addr)}
+	}
+
+	leaf := certs[0]
+	now := time.Now()
+	switch {
+	case now.Before(leaf.NotBefore):
+		msg := fmt.Sprintf("certificate served by %s is not valid until %s", addr, leaf.NotBefore.UTC().Format(time.RFC3339))
+		return HealthCheckError{Code: 8, Message: msg}
+	case now.After(leaf.NotAfter):
+		msg := fmt.Sprintf("certificate served by %s expired at %s", addr, leaf.NotAfter.UTC().Format(time.RFC3339))
+		return HealthCheckError{Code: 8, Message: msg}
+	case now.Add(h.certExpiryWindow).After(leaf.NotAfter):
+		msg := fmt.Sprintf(
+			"certificate served by %s expires at %s, within the %s expiry window",
+			addr,
+			leaf.NotAfter.UTC().Format(time.RFC3339),
+			h.certExpiryWindow,
+		)
+		return HealthCheckError{Code: 8, Message: msg}
+	}
+
+	return nil
 }
@@ -1,10 +1,21 @@
 package healthcheck_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/healthcheck"
@@ -106,6 +117,19 @@ var _ = Describe("HealthCheck", func() {
 			})
 		})
 
+		It("logs which interface address is checked", func() {
+			interfaces, err := net.Interfaces()
+			Expect(err).NotTo(HaveOccurred())
+
+			messages := []string{}
+			hc.SetLogger(func(format string, args ...interface{}) {
+				messages = append(messages, fmt.Sprintf(format, args...))
+			})
+
+			Expect(hc.CheckInterfaces(interfaces)).To(Succeed())
+			Expect(messages).To(ContainElement(HavePrefix("selected address " + ip + " of interface")))
+		})
+
 		It("fails appropriately when there are no interfaces", func() {
 			err := hc.CheckInterfaces(nil)
 			Expect(err).To(HaveOccurred())
@@ -115,6 +139,45 @@ var _ = Describe("HealthCheck", func() {
 			Expect(hErr.Code).To(Equal(3))
 			Expect(hErr.Message).To(ContainSubstring("failure to find suitable interface"))
 		})
+
+		Context("when the address of the interfaces has been looked up", func() {
+			It("checks the address without looking it up again", func() {
+				messages := []string{}
+				hc.SetLogger(func(format string, args ...interface{}) {
+					messages = append(messages, fmt.Sprintf(format, args...))
+				})
+
+				ctx := healthcheck.WithInterfaceAddress(context.Background(), ip)
+				Expect(hc.CheckInterfacesContext(ctx, nil)).To(Succeed())
+				Expect(messages).To(BeEmpty())
+			})
+
+			It("fails appropriately when no address was found", func() {
+				interfaces, err := net.Interfaces()
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx := healthcheck.WithInterfaceAddress(context.Background(), "")
+				err = hc.CheckInterfacesContext(ctx, interfaces)
+				Expect(err).To(BeAssignableToTypeOf(healthcheck.HealthCheckError{}))
+				Expect(err.(healthcheck.HealthCheckError).Code).To(Equal(3))
+			})
+		})
+	})
+
+	Describe("interface address", func() {
+		It("returns the first non-loopback IPv4 address", func() {
+			interfaces, err := net.Interfaces()
+			Expect(err).NotTo(HaveOccurred())
+
+			address, ok := healthcheck.InterfaceAddress(interfaces)
+			Expect(ok).To(BeTrue())
+			Expect(address).To(Equal(ip))
+		})
+
+		It("returns false when there are no interfaces", func() {
+			_, ok := healthcheck.InterfaceAddress(nil)
+			Expect(ok).To(BeFalse())
+		})
 	})
 
 	Describe("port healthcheck", func() {
@@ -143,6 +206,16 @@ var _ = Describe("HealthCheck", func() {
 			})
 		})
 
+		Context("when the context is cancelled", func() {
+			It("returns healthcheck error with code 4 with an appropriate message", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				itReturnsHealthCheckError(func() error {
+					return hc.PortHealthCheckContext(ctx, ip)
+				}, 4, "operation was canceled")
+			})
+		})
+
 		Context("when the server is slow in responding", func() {
 			BeforeEach(func() {
 				if runtime.GOOS == "windows" {
@@ -173,6 +246,18 @@ var _ = Describe("HealthCheck", func() {
 				It("succeeds", func() {
 					Expect(httpHealthCheck()).To(Succeed())
 				})
+
+				It("reports the breakdown of the duration of the request", func() {
+					var timings []healthcheck.HTTPTimings
+					ctx := healthcheck.WithHTTPTimingsHandler(context.Background(), func(t healthcheck.HTTPTimings) {
+						timings = append(timings, t)
+					})
+					Expect(hc.HTTPHealthCheckContext(ctx, ip)).To(Succeed())
+					Expect(timings).To(HaveLen(1))
+					Expect(timings[0].Connect).To(BeNumerically(">", 0))
+					Expect(timings[0].TimeToFirstByte).To(BeNumerically(">", 0))
+					Expect(timings[0].Total()).To(BeNumerically(">=", timings[0].TimeToFirstByte))
+				})
 			})
 
 			Context("when the address returns error http code", func() {
@@ -188,6 +273,16 @@ var _ = Describe("HealthCheck", func() {
 					)
 					itReturnsHealthCheckError(httpHealthCheck, 6, errMsg)
 				})
+
+				It("breaks the duration of the request down", func() {
+					err := httpHealthCheck()
+					Expect(err).To(BeAssignableToTypeOf(healthcheck.HealthCheckError{}))
+					timings := err.(healthcheck.HealthCheckError).Timings
+					Expect(timings).NotTo(BeNil())
+					Expect(timings.Connect).To(BeNumerically(">", 0))
+					Expect(timings.TLSHandshake).To(BeZero())
+					Expect(timings.TimeToFirstByte).To(BeNumerically(">", 0))
+				})
 			})
 
 			Context("when the address is not listening", func() {
@@ -222,6 +317,23 @@ var _ = Describe("HealthCheck", func() {
 				})
 			})
 
+			Context("when the handler is too slow to respond", func() {
+				BeforeEach(func() {
+					serverDelay = time.Second
+				})
+
+				It("reports the phases completed before the timeout", func() {
+					errMsg := fmt.Sprintf(
+						"failed to make HTTP request to '%s' on port %s: timed out after %.2f seconds (connect ",
+						uri,
+						port,
+						timeout.Seconds(),
+					)
+					itReturnsHealthCheckError(httpHealthCheck, 65, errMsg)
+					itReturnsHealthCheckError(httpHealthCheck, 65, "ms, no response received)")
+				})
+			})
+
 			Context("with a tls-aware endpoint", func() {
 				var request *http.Request
 				BeforeEach(func() {
@@ -244,12 +356,368 @@ var _ = Describe("HealthCheck", func() {
 					Expect(request.Header.Get("User-Agent")).To(Equal("diego-healthcheck"))
 				})
 
+				It("sends the headers set on the check", func() {
+					hc.SetHeaders(http.Header{
+						"User-Agent": {"kube-probe/1.30"},
+						"X-Probe":    {"liveness"},
+						"Host":       {"app.example.com"},
+					})
+					err := hc.HTTPHealthCheck(ip)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(request.Header.Get("User-Agent")).To(Equal("kube-probe/1.30"))
+					Expect(request.Header.Get("X-Probe")).To(Equal("liveness"))
+					Expect(request.Host).To(Equal("app.example.com"))
+				})
+
+			})
+
+		})
+	})
+
+	Describe("host healthcheck", func() {
+		BeforeEach(func() {
+			uri = "/api/_ping"
+		})
+
+		It("checks the host instead of the address of the interfaces", func() {
+			Expect(hc.CheckHostContext(context.Background(), ip)).To(Succeed())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("fails when the host cannot be resolved", func() {
+			err := hc.CheckHostContext(context.Background(), "healthcheck.invalid")
+			Expect(err).To(HaveOccurred())
+			Expect(err.(healthcheck.HealthCheckError).Code).To(Equal(5))
+		})
+	})
+
+	Describe("https healthcheck", func() {
+		var tlsServer *httptest.Server
+
+		BeforeEach(func() {
+			tlsServer = httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/api/_ping" {
+					resp.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			listener, err := net.Listen("tcp", ip+":0")
+			Expect(err).NotTo(HaveOccurred())
+			tlsServer.Listener = listener
+			tlsServer.StartTLS()
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		It("makes an HTTPS request without verifying the certificate", func() {
+			_, tlsPort, err := net.SplitHostPort(tlsServer.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+
+			hc = healthcheck.NewHTTPSHealthCheck("tcp", "/api/_ping", tlsPort, time.Second)
+			Expect(hc.HTTPHealthCheck(ip)).To(Succeed())
+
+			hc = healthcheck.NewHTTPSHealthCheck("tcp", "/missing", tlsPort, time.Second)
+			itReturnsHealthCheckError(func() error { return hc.HTTPHealthCheck(ip) }, 6, "received status code 404")
+		})
+	})
+
+	Describe("grpc healthcheck", func() {
+		var (
+			grpcServer *httptest.Server
+			grpcPort   string
+			statuses   map[string]int
+		)
+
+		BeforeEach(func() {
+			statuses = map[string]int{"": 1, "app": 1}
+		})
+
+		JustBeforeEach(func() {
+			grpcServer = newGRPCHealthServer(ip, statuses, serverDelay)
+			var err error
+			_, grpcPort, err = net.SplitHostPort(grpcServer.Listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			grpcServer.Close()
+		})
+
+		grpcHealthCheck := func(service string) func() error {
+			return func() error {
+				hc = healthcheck.NewGRPCHealthCheck("tcp", service, grpcPort, timeout)
+				return hc.CheckHostContext(context.Background(), ip)
+			}
+		}
+
+		It("succeeds when the server is serving", func() {
+			Expect(grpcHealthCheck("")()).To(Succeed())
+		})
+
+		Context("when only the service is serving", func() {
+			BeforeEach(func() {
+				statuses[""] = 2
+			})
+
+			It("asks about the service", func() {
+				Expect(grpcHealthCheck("app")()).To(Succeed())
+			})
+		})
+
+		Context("when the service is not serving", func() {
+			BeforeEach(func() {
+				statuses["app"] = 2
+			})
+
+			It("returns healthcheck error with code 11 with an appropriate message", func() {
+				itReturnsHealthCheckError(grpcHealthCheck("app"), 11, fmt.Sprintf(`gRPC health service on port %s reports service "app" as NOT_SERVING`, grpcPort))
+			})
+		})
+
+		Context("when the service is unknown", func() {
+			It("returns healthcheck error with code 10 with an appropriate message", func() {
+				itReturnsHealthCheckError(grpcHealthCheck("other"), 10, "received gRPC status 5: unknown service")
+			})
+		})
+
+		Context("when the server is too slow to respond", func() {
+			BeforeEach(func() {
+				serverDelay = time.Second
+			})
+
+			It("returns healthcheck error with code 68 with an appropriate message", func() {
+				itReturnsHealthCheckError(grpcHealthCheck(""), 68, "failed to call the gRPC health service on port "+grpcPort+": timed out after 0.10 seconds")
+			})
+		})
+
+		Context("when the address is not listening", func() {
+			It("returns healthcheck error with code 10 with an appropriate message", func() {
+				grpcServer.Close()
+				itReturnsHealthCheckError(grpcHealthCheck(""), 10, "failed to call the gRPC health service on port "+grpcPort)
+			})
+		})
+	})
+
+	Describe("tracing", func() {
+		var tracer *fakeTracer
+
+		JustBeforeEach(func() {
+			tracer = &fakeTracer{}
+			hc.SetTracer(tracer)
+		})
+
+		Context("with an http healthcheck", func() {
+			var request *http.Request
+
+			BeforeEach(func() {
+				uri = "/api/_ping"
+				handler = func(resp http.ResponseWriter, req *http.Request) {
+					request = req
+				}
+			})
+
+			It("records a span with the timings of the request", func() {
+				Expect(hc.HTTPHealthCheck(ip)).To(Succeed())
+
+				Expect(tracer.spans).To(HaveLen(1))
+				span := tracer.spans[0]
+				Expect(span.name).To(Equal("http healthcheck"))
+				Expect(span.events).To(ContainElements("connect_start", "connect_done", "first_response_byte"))
+				Expect(span.attributes).To(HaveKeyWithValue("http.response.status_code", "200"))
+				Expect(span.ended).To(BeTrue())
+				Expect(span.err).NotTo(HaveOccurred())
+			})
+
+			It("propagates the span in the traceparent header", func() {
+				Expect(hc.HTTPHealthCheck(ip)).To(Succeed())
+				Expect(request.Header.Get("traceparent")).To(Equal(tracer.spans[0].TraceParent()))
+			})
+		})
+
+		Context("with a port healthcheck", func() {
+			BeforeEach(func() {
+				uri = ""
 			})
 
+			It("records a span ended with the error of the check", func() {
+				server.Close()
+				server = nil
+
+				err := hc.PortHealthCheck(ip)
+				Expect(err).To(HaveOccurred())
+
+				Expect(tracer.spans).To(HaveLen(1))
+				span := tracer.spans[0]
+				Expect(span.name).To(Equal("tcp healthcheck"))
+				Expect(span.events).To(Equal([]string{"connect_start", "connect_done"}))
+				Expect(span.err).To(Equal(err))
+			})
+		})
+	})
+
+	Describe("tls healthcheck", func() {
+		var (
+			tlsListener  net.Listener
+			tlsPort      string
+			notBefore    time.Time
+			notAfter     time.Time
+			expiryWindow time.Duration
+		)
+
+		tlsHealthCheck := func() error {
+			return hc.TLSHealthCheck(ip)
+		}
+
+		BeforeEach(func() {
+			notBefore = time.Now().Add(-time.Hour)
+			notAfter = time.Now().Add(24 * time.Hour)
+			expiryWindow = time.Hour
+		})
+
+		JustBeforeEach(func() {
+			var err error
+			tlsListener, err = tls.Listen("tcp", ip+":0", &tls.Config{
+				Certificates: []tls.Certificate{generateCertificate(notBefore, notAfter)},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			go func(listener net.Listener) {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.(*tls.Conn).Handshake()
+					conn.Close()
+				}
+			}(tlsListener)
+
+			_, tlsPort, err = net.SplitHostPort(tlsListener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+
+			hc = healthcheck.NewTLSHealthCheck("tcp", tlsPort, timeout, expiryWindow)
+		})
+
+		AfterEach(func() {
+			tlsListener.Close()
+		})
+
+		Context("when the certificate is valid", func() {
+			It("succeeds", func() {
+				Expect(tlsHealthCheck()).To(Succeed())
+			})
+
+			It("is used by check interfaces", func() {
+				interfaces, err := net.Interfaces()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(hc.CheckInterfaces(interfaces)).To(Succeed())
+			})
+		})
+
+		Context("when the certificate has expired", func() {
+			BeforeEach(func() {
+				notAfter = time.Now().Add(-time.Minute)
+			})
+
+			It("returns healthcheck error with code 8 with an appropriate message", func() {
+				errMsg := fmt.Sprintf("certificate served by %s:%s expired at", ip, tlsPort)
+				itReturnsHealthCheckError(tlsHealthCheck, 8, errMsg)
+			})
+		})
+
+		Context("when the certificate is not yet valid", func() {
+			BeforeEach(func() {
+				notBefore = time.Now().Add(time.Hour)
+			})
+
+			It("returns healthcheck error with code 8 with an appropriate message", func() {
+				errMsg := fmt.Sprintf("certificate served by %s:%s is not valid until", ip, tlsPort)
+				itReturnsHealthCheckError(tlsHealthCheck, 8, errMsg)
+			})
+		})
+
+		Context("when the certificate expires within the expiry window", func() {
+			BeforeEach(func() {
+				expiryWindow = 48 * time.Hour
+			})
+
+			It("returns healthcheck error with code 8 with an appropriate message", func() {
+				itReturnsHealthCheckError(tlsHealthCheck, 8, "within the 48h0m0s expiry window")
+			})
+		})
+
+		Context("when the server does not speak TLS", func() {
+			JustBeforeEach(func() {
+				hc = healthcheck.NewTLSHealthCheck("tcp", port, timeout, expiryWindow)
+			})
+
+			It("returns healthcheck error with code 7 with an appropriate message", func() {
+				errMsg := fmt.Sprintf("failed to complete TLS handshake with %s:%s", ip, port)
+				itReturnsHealthCheckError(tlsHealthCheck, 7, errMsg)
+			})
 		})
 	})
 })
 
+func generateCertificate(notBefore, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "healthcheck"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newGRPCHealthServer serves the gRPC health service on ip, reporting the
+// status of the services in statuses and NOT_FOUND for the other services, as
+// gRPC servers do.
+func newGRPCHealthServer(ip string, statuses map[string]int, delay time.Duration) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+
+		body, err := io.ReadAll(req.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(req.URL.Path).To(Equal("/grpc.health.v1.Health/Check"))
+		Expect(req.Header.Get("Content-Type")).To(Equal("application/grpc"))
+
+		// The requests carry the service, if any, as their only field.
+		service := ""
+		if len(body) > 7 {
+			service = string(body[7:])
+		}
+
+		resp.Header().Set("Content-Type", "application/grpc")
+		status, ok := statuses[service]
+		if !ok {
+			resp.Header().Set("Grpc-Status", "5")
+			resp.Header().Set("Grpc-Message", "unknown service")
+			return
+		}
+		resp.Header().Set("Trailer", "Grpc-Status")
+		_, err = resp.Write([]byte{0, 0, 0, 0, 2, 0x08, byte(status)})
+		Expect(err).NotTo(HaveOccurred())
+		resp.Header().Set("Grpc-Status", "0")
+	}))
+
+	listener, err := net.Listen("tcp", ip+":0")
+	Expect(err).NotTo(HaveOccurred())
+	server.Listener = listener
+	server.Config.Protocols = &http.Protocols{}
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
 func getNonLoopbackIP() string {
 	interfaces, err := net.Interfaces()
 	Expect(err).NotTo(HaveOccurred())
@@ -270,3 +738,43 @@ func getNonLoopbackIP() string {
 	Fail("no non-loopback address found")
 	panic("non-reachable")
 }
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) StartSpan(ctx context.Context, name string) healthcheck.Span {
+	span := &fakeSpan{name: name, attributes: map[string]string{}}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+type fakeSpan struct {
+	mu         sync.Mutex
+	name       string
+	attributes map[string]string
+	events     []string
+	ended      bool
+	err        error
+}
+
+func (s *fakeSpan) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *fakeSpan) AddEvent(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, name)
+}
+
+func (s *fakeSpan) TraceParent() string {
+	return "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+}
+
+func (s *fakeSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
@@ -0,0 +1,171 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPTimings is the breakdown of the duration of an HTTP check. Phases that
+// did not complete are zero.
+type HTTPTimings struct {
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// TimeToFirstByte is the time between the request being written and the
+	// first byte of the response, i.e. the time taken by the handler.
+	TimeToFirstByte time.Duration
+	BodyRead        time.Duration
+}
+
+func (t HTTPTimings) String() string {
+	phases := []string{}
+	for _, phase := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"connect", t.Connect},
+		{"TLS handshake", t.TLSHandshake},
+		{"time to first byte", t.TimeToFirstByte},
+		{"body read", t.BodyRead},
+	} {
+		if phase.duration > 0 {
+			phases = append(phases, fmt.Sprintf("%s %s", phase.name, formatMilliseconds(phase.duration)))
+		}
+	}
+	return strings.Join(phases, ", ")
+}
+
+// Total returns the sum of the phases.
+func (t HTTPTimings) Total() time.Duration {
+	return t.Connect + t.TLSHandshake + t.TimeToFirstByte + t.BodyRead
+}
+
+type timingsHandlerKey struct{}
+
+// WithHTTPTimingsHandler returns a context making the HTTP checks run with it
+// call handler with the breakdown of their duration once they complete,
+// whether they pass or fail, as httptrace.WithClientTrace does for the events
+// of a request. The components of a composite check may call handler
+// concurrently. A nil handler stops the HTTP checks from calling the handler
+// of ctx.
+func WithHTTPTimingsHandler(ctx context.Context, handler func(HTTPTimings)) context.Context {
+	return context.WithValue(ctx, timingsHandlerKey{}, handler)
+}
+
+func reportTimings(ctx context.Context, t HTTPTimings) {
+	if handler, _ := ctx.Value(timingsHandlerKey{}).(func(HTTPTimings)); handler != nil {
+		handler(t)
+	}
+}
+
+func formatMilliseconds(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+// httpTimer records when the phases of an HTTP check start and end. The
+// callbacks of the HTTP client may run after the check timed out, from
+// another goroutine.
+type httpTimer struct {
+	mu           sync.Mutex
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	bodyStart    time.Time
+	bodyDone     time.Time
+}
+
+func (t *httpTimer) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at.IsZero() {
+		*at = time.Now()
+	}
+}
+
+// clientTrace returns an httptrace.ClientTrace recording the phases of an
+// HTTP request in the timer and as events of span.
+func (t *httpTimer) clientTrace(span Span) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { span.AddEvent("dns_start") },
+		DNSDone:  func(httptrace.DNSDoneInfo) { span.AddEvent("dns_done") },
+		ConnectStart: func(string, string) {
+			t.mark(&t.connectStart)
+			span.AddEvent("connect_start")
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				t.mark(&t.connectDone)
+			}
+			span.AddEvent("connect_done")
+		},
+		TLSHandshakeStart: func() {
+			t.mark(&t.tlsStart)
+			span.AddEvent("tls_handshake_start")
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				t.mark(&t.tlsDone)
+			}
+			span.AddEvent("tls_handshake_done")
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mark(&t.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+			span.AddEvent("first_response_byte")
+		},
+	}
+}
+
+func (t *httpTimer) timings() HTTPTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	between := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+		return end.Sub(start)
+	}
+	return HTTPTimings{
+		Connect:         between(t.connectStart, t.connectDone),
+		TLSHandshake:    between(t.tlsStart, t.tlsDone),
+		TimeToFirstByte: between(t.wroteRequest, t.firstByte),
+		BodyRead:        between(t.bodyStart, t.bodyDone),
+	}
+}
+
+// pending describes the phase the check was in when it timed out.
+func (t *httpTimer) pending() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.connectDone.IsZero():
+		return "connect did not complete"
+	case !t.tlsStart.IsZero() && t.tlsDone.IsZero():
+		return "TLS handshake did not complete"
+	case t.firstByte.IsZero():
+		return "no response received"
+	default:
+		return "body read did not complete"
+	}
+}
+
+// describeTimeout describes the completed phases and the phase the check
+// was in when it timed out, e.g. (connect 0.2ms, no response received).
+func (t *httpTimer) describeTimeout() string {
+	phases := t.timings().String()
+	if phases != "" {
+		phases += ", "
+	}
+	return "(" + phases + t.pending() + ")"
+}
@@ -0,0 +1,39 @@
+package healthcheck
+
+import "context"
+
+// Tracer starts a Span for every probe made by a HealthCheck.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) Span
+}
+
+// Span records the events of a single probe, e.g. the start and end of the
+// DNS lookup, dial, TLS handshake and the first response byte.
+type Span interface {
+	SetAttribute(key, value string)
+	AddEvent(name string)
+	// TraceParent returns the W3C traceparent header identifying the span,
+	// sent along with HTTP probes.
+	TraceParent() string
+	// End ends the span, err is the outcome of the probe.
+	End(err error)
+}
+
+// SetTracer sets the Tracer starting a span for every probe.
+func (h *HealthCheck) SetTracer(tracer Tracer) {
+	h.tracer = tracer
+}
+
+func (h *HealthCheck) startSpan(ctx context.Context, name string) Span {
+	if h.tracer == nil {
+		return noopSpan{}
+	}
+	return h.tracer.StartSpan(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, string) {}
+func (noopSpan) AddEvent(string)             {}
+func (noopSpan) TraceParent() string         { return "" }
+func (noopSpan) End(error)                   {}